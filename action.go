@@ -1,22 +1,93 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/mistify-agent/client"
 	"github.com/mistifyio/mistify-agent/config"
+	"github.com/mistifyio/mistify-agent/rpc"
 	"github.com/pborman/uuid"
 )
 
 type (
 	// Stage is a single step an action must take
 	Stage struct {
-		Service  *Service
-		Type     config.ActionType
-		Method   string
-		Args     map[string]string
-		Request  interface{}
-		Response interface{}
-		RW       http.ResponseWriter // For streaming responses
+		Name         string // Key for the stage's response in Outputs, if set
+		Service      *Service
+		Type         config.ActionType
+		Method       string
+		Args         map[string]string
+		Retry        config.RetryPolicy
+		Timeout      time.Duration // Limit for the stage, including retries
+		Request      interface{}
+		Response     interface{}
+		RW           http.ResponseWriter // For streaming responses
+		Compensate   *Stage              // Undoes the stage if a later stage fails
+		Parallel     []*Stage            // Stages run concurrently in place of this one
+		When         *template.Template  // Condition for running the stage
+		ArgTemplates map[string]*template.Template
+		Attempts     []*StageAttempt
+		pipeline     *Pipeline
+	}
+
+	// StageAttempt records a single try at running a stage
+	StageAttempt struct {
+		Service    string
+		Method     string
+		Attempt    uint
+		StartedAt  time.Time
+		FinishedAt time.Time
+		Error      string
+		RetryAfter int    // Seconds the sub-agent asked the agent to wait
+		Message    string // Informational message returned by the sub-agent
+	}
+
+	// StageRollback records the compensation of a completed stage after a
+	// later stage failed
+	StageRollback struct {
+		Stage      string // Method of the stage being undone
+		Index      int    // Position of the stage being undone in the pipeline
+		Member     int    // Position of the stage being undone within its parallel group, or -1
+		Service    string
+		Method     string
+		StartedAt  time.Time
+		FinishedAt time.Time
+		Error      string
+	}
+
+	// completedStage is a stage that completed, with its position in the
+	// pipeline
+	completedStage struct {
+		stage  *Stage
+		index  int
+		member int // Position within the stage's parallel group, or -1
+	}
+
+	// StageProgress records the state of a stage in a running pipeline. A new
+	// StageProgress is reported when the stage starts and when it finishes.
+	StageProgress struct {
+		Index      int // Position of the stage in the pipeline
+		Member     int // Position within the stage's parallel group, or -1
+		Service    string
+		Method     string
+		StartedAt  time.Time
+		FinishedAt time.Time
+		Status     JobStatus
+		Message    string // Informational message from the sub-agent
+		Error      string
 	}
 
 	// Pipeline is a full set of stage instances required to complete an action
@@ -24,40 +95,313 @@ type (
 		ID            string
 		Action        string
 		Type          config.ActionType
+		Priority      int         // Queued async pipelines with higher priorities run first
+		Coalesce      bool        // Merge into an identical queued pipeline
+		Callbacks     []*Callback // Notified when an async pipeline finishes
 		Stages        []*Stage
 		PreStageFunc  func(*Pipeline, *Stage) error
 		PostStageFunc func(*Pipeline, *Stage) error
-		DoneChan      chan error // Signal async is done or errored, for post-hooks
+		AttemptFunc   func(*Pipeline, *Stage, *StageAttempt)
+		RollbackFunc  func(*Pipeline, *StageRollback)
+		SkipFunc      func(*Pipeline, *Stage)
+		ProgressFunc  func(*Pipeline, *StageProgress)
+		HookFunc      func(*Pipeline, *HookRun)
+		Rollbacks     []*StageRollback
+		Skipped       []*Stage
+		Outputs       map[string]interface{} // Responses of completed named stages, by name
+		DoneChan      chan error             // Signal async is done or errored, for post-hooks
+		ctx           *Context
+		metadata      map[string]string
+		mutex         sync.Mutex         // Guards cancellation
+		cancel        context.CancelFunc // Cancels the context of a running pipeline
+		cancelled     bool
+		finished      bool
+		before        []*Stage // Hook stages
+		success       []*Stage
+		failure       []*Stage
+		err           error // Error of a failed pipeline, for failure hooks
+		request       interface{}
+		coalesceKey   string
+		recovers      string // ID of the interrupted job the pipeline recovers
 	}
 
 	// Action is a full set of stage templates required to complete an action
 	Action struct {
-		Name   string
+		Name     string
+		Type     config.ActionType
+		Custom   bool // Configured outside of the built-in actions
+		Priority int
+		Coalesce bool
+		Recovery string // Run if the action was interrupted by a restart
+		Stages   []*Stage
+		ctx      *Context
+	}
+
+	// ActionInfo describes a configured action
+	ActionInfo struct {
+		Name     string
+		Type     string
+		Custom   bool
+		Priority int
+		Recovery string
+		Stages   []config.Stage
+	}
+
+	// StageData is the data available to stage templates. Guest is nil for
+	// actions that do not operate on a guest.
+	StageData struct {
+		Guest    *client.Guest
+		Metadata map[string]string      // Hypervisor metadata
+		Outputs  map[string]interface{} // Responses of earlier named stages, by name
+		Error    string                 // Error of the failed action, for failure hooks
+	}
+
+	// Plan describes what a pipeline would do if it were run
+	Plan struct {
+		Action string
 		Type   config.ActionType
-		Stages []*Stage
+		Stages []*PlannedStage
 	}
+
+	// PlannedStage describes what a stage would do if its pipeline were run
+	PlannedStage struct {
+		Service    string
+		Method     string
+		Args       map[string]string
+		Request    interface{}
+		Skipped    bool
+		Error      string
+		Parallel   []*PlannedStage
+		Compensate *PlannedStage
+	}
+
+	// GroupError aggregates the errors of the stages in a parallel group
+	GroupError struct {
+		Errors []error
+	}
+
+	// StageTimeoutError is the error for a stage, or a single call made by a
+	// stage, that did not finish in time
+	StageTimeoutError struct {
+		Method  string
+		Timeout time.Duration
+	}
+)
+
+func (e *GroupError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *StageTimeoutError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("%s timed out after %s", e.Method, e.Timeout)
+	}
+	return fmt.Sprintf("%s timed out", e.Method)
+}
+
+var (
+	// ErrCancelled is the error for a pipeline that was cancelled
+	ErrCancelled = errors.New("cancelled")
+
+	// ErrCoalesced is the error for a pipeline that was merged into an
+	// identical queued pipeline instead of being run
+	ErrCoalesced = errors.New("coalesced into an existing job")
 )
 
-// Run makes an individual stage request
-func (stage *Stage) Run() error {
+// Run makes an individual stage request. Failed requests are retried
+// according to the stage's retry policy, as are requests the sub-agent asks to
+// have retried. A retry requested on the last allowed attempt is ignored and the
+// response is used as it is. Retries stop once the context is done or the stage
+// timeout passes.
+func (stage *Stage) Run(ctx context.Context) error {
+	if stage.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stage.Timeout)
+		defer cancel()
+	}
+
 	if stage.Type == config.StreamAction {
-		stage.Service.Client.DoRaw(stage.Request, stage.RW)
+		stage.Service.Client.DoRawContext(ctx, stage.Request, stage.RW)
 		return nil
 	}
-	return stage.Service.Client.Do(stage.Method, stage.Request, stage.Response)
+
+	maxAttempts := stage.Retry.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 1
+	}
+
+	for attempt := uint(1); ; attempt++ {
+		if attempt > 1 {
+			delay := stage.Retry.Delay(attempt - 1)
+			if n := len(stage.Attempts); n > 0 && stage.Attempts[n-1].RetryAfter > 0 {
+				delay = time.Duration(stage.Attempts[n-1].RetryAfter) * time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return stage.contextError(ctx)
+			case <-time.After(delay):
+			}
+		}
+
+		final := attempt == maxAttempts
+		retryAfter, err := stage.attempt(ctx, attempt, final)
+		if err == nil && (retryAfter == 0 || final) {
+			return nil
+		}
+		if ctx.Err() != nil {
+			if err == nil {
+				err = stage.contextError(ctx)
+			}
+			return err
+		}
+		if err != nil && (final || !stage.Retry.Retries(errorClass(err))) {
+			return err
+		}
+	}
+}
+
+// attempt makes a single stage request and records it. It returns the number
+// of seconds the sub-agent asked to wait before retrying, if any. On the final
+// attempt a requested retry is recorded but not treated as an error.
+func (stage *Stage) attempt(ctx context.Context, n uint, final bool) (int, error) {
+	record := &StageAttempt{
+		Attempt:   n,
+		Method:    stage.Method,
+		StartedAt: time.Now(),
+	}
+	if stage.Service != nil {
+		record.Service = stage.Service.Name
+	}
+
+	// Clear any retry request left over from a previous stage or attempt
+	guestResponse, isGuestResponse := stage.Response.(*rpc.GuestResponse)
+	if isGuestResponse {
+		guestResponse.Retry = 0
+	}
+
+	err := stage.Service.Client.DoContext(ctx, stage.Method, stage.Request, stage.Response)
+	if err == context.DeadlineExceeded {
+		if ctx.Err() != nil {
+			// The stage as a whole ran out of time
+			err = stage.contextError(ctx)
+		} else {
+			// Only this call ran out of time
+			err = &StageTimeoutError{
+				Method:  stage.Method,
+				Timeout: stage.Service.Client.Timeout,
+			}
+		}
+	}
+	record.FinishedAt = time.Now()
+	if err != nil {
+		record.Error = err.Error()
+	} else if isGuestResponse && guestResponse.Retry > 0 {
+		record.RetryAfter = guestResponse.Retry
+		if !final {
+			record.Error = fmt.Sprintf("sub-agent requested retry after %ds", guestResponse.Retry)
+		}
+	}
+	if err == nil && isGuestResponse {
+		record.Message = guestResponse.Message
+	}
+
+	stage.Attempts = append(stage.Attempts, record)
+	if stage.pipeline != nil && stage.pipeline.AttemptFunc != nil {
+		stage.pipeline.AttemptFunc(stage.pipeline, stage, record)
+	}
+	return record.RetryAfter, err
+}
+
+// contextError converts the error of a finished context into a stage error
+func (stage *Stage) contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &StageTimeoutError{
+			Method:  stage.Method,
+			Timeout: stage.Timeout,
+		}
+	}
+	return ctx.Err()
+}
+
+// errorClass determines the retry class of a stage request error
+func errorClass(err error) string {
+	switch err.(type) {
+	case *StageTimeoutError:
+		return config.RetryTimeout
+	case *rpc.TransportError:
+		return config.RetryTransport
+	case *rpc.StatusError:
+		return config.RetryStatus
+	default:
+		return config.RetryRPC
+	}
 }
 
 // Run executes each stage in the pipeline. It bails out as soon as an error
-// is encountered
-func (pipeline *Pipeline) Run() error {
+// is encountered, the context is done, or the pipeline is cancelled, after
+// running the compensating stages of any stages that already completed.
+// Success and failure hooks run under the given context, so that they still
+// run for a cancelled pipeline.
+func (pipeline *Pipeline) Run(parent context.Context) error {
+	pipeline.mutex.Lock()
+	ctx, cancel := context.WithCancel(parent)
+	pipeline.cancel = cancel
+	pipeline.mutex.Unlock()
+	defer cancel()
+
+	pipeline.runHooks(ctx, HookBefore, pipeline.before)
+
 	var err error
-	for _, stage := range pipeline.Stages {
+	var completed []completedStage
+	for i, stage := range pipeline.Stages {
+		if pipeline.Cancelled() {
+			err = ErrCancelled
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var run bool
+		if run, err = stage.shouldRun(); err != nil {
+			break
+		}
+		if !run {
+			pipeline.skip(stage)
+			continue
+		}
+		if len(stage.Parallel) > 0 {
+			var done []completedStage
+			done, err = pipeline.runGroup(ctx, i, stage)
+			completed = append(completed, done...)
+			if err != nil {
+				break
+			}
+			// A named group's output is the merged response of its stages
+			if err = pipeline.recordOutput(stage); err != nil {
+				break
+			}
+			continue
+		}
+		if err = stage.renderArgs(); err != nil {
+			break
+		}
 		if pipeline.PreStageFunc != nil {
 			if err = pipeline.PreStageFunc(pipeline, stage); err != nil {
 				break
 			}
 		}
-		if err = stage.Run(); err != nil {
+		progress := pipeline.startProgress(i, -1, stage)
+		err = stage.Run(ctx)
+		pipeline.finishProgress(progress, stage, err)
+		if err != nil {
+			break
+		}
+		completed = append(completed, completedStage{stage: stage, index: i, member: -1})
+		if err = pipeline.recordOutput(stage); err != nil {
 			break
 		}
 		if pipeline.PostStageFunc != nil {
@@ -66,12 +410,502 @@ func (pipeline *Pipeline) Run() error {
 			}
 		}
 	}
+	// Once finished, the pipeline can no longer be cancelled. One cancelled
+	// before then always ends as cancelled, whatever its stages did.
+	pipeline.mutex.Lock()
+	pipeline.finished = true
+	if pipeline.cancelled {
+		err = ErrCancelled
+	}
+	pipeline.mutex.Unlock()
+	if err != nil {
+		pipeline.rollback(completed)
+		pipeline.err = err
+		pipeline.runHooks(parent, HookFailure, pipeline.failure)
+	} else {
+		pipeline.runHooks(parent, HookSuccess, pipeline.success)
+	}
 	if pipeline.DoneChan != nil {
 		pipeline.DoneChan <- err
 	}
 	return err
 }
 
+// Cancel stops the pipeline, interrupting the running stage along with any
+// wait before retrying it. It returns false if the pipeline has already
+// finished its stages.
+func (pipeline *Pipeline) Cancel() bool {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	if pipeline.finished {
+		return false
+	}
+	pipeline.cancelled = true
+	if pipeline.cancel != nil {
+		pipeline.cancel()
+	}
+	return true
+}
+
+// Cancelled reports whether the pipeline has been cancelled
+func (pipeline *Pipeline) Cancelled() bool {
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+
+	return pipeline.cancelled
+}
+
+// identity describes what the pipeline would do, for finding identical
+// pipelines. Pipelines are identical if they are for the same action and
+// their requests are the same.
+func (pipeline *Pipeline) identity() (string, error) {
+	data, err := json.Marshal(pipeline.request)
+	if err != nil {
+		return "", err
+	}
+	return pipeline.Action + " " + string(data), nil
+}
+
+// Plan works out what the pipeline would do without calling any sub-agents.
+// Stage conditions and args are evaluated and PreStageFunc is applied to build
+// each request, but PostStageFunc is not called. Since no stages actually run,
+// templates relying on the outputs of earlier stages result in an error for
+// that stage.
+func (pipeline *Pipeline) Plan() *Plan {
+	plan := &Plan{
+		Action: pipeline.Action,
+		Type:   pipeline.Type,
+		Stages: make([]*PlannedStage, len(pipeline.Stages)),
+	}
+	for i, stage := range pipeline.Stages {
+		plan.Stages[i] = pipeline.planStage(stage)
+	}
+	return plan
+}
+
+// planStage works out what a single stage would do
+func (pipeline *Pipeline) planStage(stage *Stage) *PlannedStage {
+	planned := &PlannedStage{
+		Method: stage.Method,
+	}
+	if stage.Service != nil {
+		planned.Service = stage.Service.Name
+	}
+
+	run, err := stage.shouldRun()
+	if err != nil {
+		planned.Error = err.Error()
+		return planned
+	}
+	if !run {
+		planned.Skipped = true
+		return planned
+	}
+
+	if len(stage.Parallel) > 0 {
+		for _, member := range stage.Parallel {
+			planned.Parallel = append(planned.Parallel, pipeline.planStage(member))
+		}
+		return planned
+	}
+
+	if err := stage.renderArgs(); err != nil {
+		planned.Error = err.Error()
+		return planned
+	}
+	if pipeline.PreStageFunc != nil {
+		if err := pipeline.PreStageFunc(pipeline, stage); err != nil {
+			planned.Error = err.Error()
+			return planned
+		}
+	}
+	planned.Args = stage.Args
+	// Later stages may modify the request, so keep a copy of it as it is now
+	if planned.Request, err = deepCopy(stage.Request); err != nil {
+		planned.Error = err.Error()
+	}
+	if stage.Compensate != nil {
+		planned.Compensate = pipeline.planStage(stage.Compensate)
+	}
+	return planned
+}
+
+// runGroup runs a group of parallel stages and waits for all of them to
+// finish. Each stage gets its own copy of the request and a fresh response.
+// Once all are done, the responses of the successful stages are merged into the
+// group's response in configuration order, as if the stages had run one after
+// another, and PostStageFunc is called after each merge. Later stages therefore
+// take precedence, e.g. for the guest. It returns the stages that completed and
+// a GroupError of any that failed.
+func (pipeline *Pipeline) runGroup(ctx context.Context, index int, group *Stage) ([]completedStage, error) {
+	if group.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, group.Timeout)
+		defer cancel()
+	}
+
+	var members []*Stage
+	for _, member := range group.Parallel {
+		run, err := member.shouldRun()
+		if err != nil {
+			return nil, err
+		}
+		if !run {
+			pipeline.skip(member)
+			continue
+		}
+		members = append(members, member)
+	}
+	for _, member := range members {
+		if err := member.renderArgs(); err != nil {
+			return nil, err
+		}
+		if pipeline.PreStageFunc != nil {
+			if err := pipeline.PreStageFunc(pipeline, member); err != nil {
+				return nil, err
+			}
+		}
+		member.Request = copyValue(member.Request)
+		member.Response = newValue(member.Response)
+	}
+
+	// Members are identified by their position in the configured group, so
+	// that skipped members do not shift the others
+	positions := make(map[*Stage]int, len(group.Parallel))
+	for i, member := range group.Parallel {
+		positions[member] = i
+	}
+	errs := make([]error, len(members))
+	progress := make([]*StageProgress, len(members))
+	for i, member := range members {
+		progress[i] = pipeline.startProgress(index, positions[member], member)
+	}
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func(i int, member *Stage) {
+			defer wg.Done()
+			errs[i] = member.Run(ctx)
+		}(i, member)
+	}
+	wg.Wait()
+	for i, member := range members {
+		pipeline.finishProgress(progress[i], member, errs[i])
+	}
+
+	var completed []completedStage
+	groupErr := &GroupError{}
+	for i, member := range members {
+		if errs[i] != nil {
+			groupErr.Errors = append(groupErr.Errors, errs[i])
+			continue
+		}
+		completed = append(completed, completedStage{stage: member, index: index, member: positions[member]})
+		if err := pipeline.recordOutput(member); err != nil {
+			groupErr.Errors = append(groupErr.Errors, err)
+			continue
+		}
+		if err := mergeResponse(group.Response, member.Response); err != nil {
+			groupErr.Errors = append(groupErr.Errors, err)
+			continue
+		}
+		if pipeline.PostStageFunc != nil {
+			if err := pipeline.PostStageFunc(pipeline, member); err != nil {
+				groupErr.Errors = append(groupErr.Errors, err)
+			}
+		}
+	}
+	if len(groupErr.Errors) > 0 {
+		return completed, groupErr
+	}
+	return completed, nil
+}
+
+// startProgress reports that a stage is starting. Member is the stage's
+// position in a parallel group, or -1 if it is not in one.
+func (pipeline *Pipeline) startProgress(index, member int, stage *Stage) *StageProgress {
+	progress := &StageProgress{
+		Index:     index,
+		Member:    member,
+		Method:    stage.Method,
+		StartedAt: time.Now(),
+		Status:    Running,
+	}
+	if stage.Service != nil {
+		progress.Service = stage.Service.Name
+	}
+	if pipeline.ProgressFunc != nil {
+		pipeline.ProgressFunc(pipeline, progress)
+	}
+	return progress
+}
+
+// finishProgress reports the outcome of a stage. A new StageProgress is
+// reported rather than modifying the one given when the stage started.
+func (pipeline *Pipeline) finishProgress(started *StageProgress, stage *Stage, err error) {
+	progress := *started
+	progress.FinishedAt = time.Now()
+	progress.Status = Complete
+	if err != nil {
+		progress.Status = Errored
+		progress.Error = err.Error()
+	}
+	if response, ok := stage.Response.(*rpc.GuestResponse); ok && response != nil {
+		progress.Message = response.Message
+	}
+	if pipeline.ProgressFunc != nil {
+		pipeline.ProgressFunc(pipeline, &progress)
+	}
+}
+
+// recordOutput saves a copy of a completed stage's response, under the stage's
+// name, for use by the templates of later stages. Responses of unnamed stages
+// are not kept. The response itself is shared with later stages, so a deep copy
+// is made.
+func (pipeline *Pipeline) recordOutput(stage *Stage) error {
+	if stage.Name == "" || stage.Response == nil {
+		return nil
+	}
+	output, err := deepCopy(stage.Response)
+	if err != nil {
+		return err
+	}
+	if pipeline.Outputs == nil {
+		pipeline.Outputs = make(map[string]interface{})
+	}
+	pipeline.Outputs[stage.Name] = output
+	return nil
+}
+
+// hypervisorMetadata loads the hypervisor metadata for templates, once per
+// pipeline
+func (pipeline *Pipeline) hypervisorMetadata() (map[string]string, error) {
+	if pipeline.metadata != nil || pipeline.ctx == nil {
+		return pipeline.metadata, nil
+	}
+	metadata, err := pipeline.ctx.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+	pipeline.metadata = metadata
+	return metadata, nil
+}
+
+// skip records a stage that was not run because of its when condition
+func (pipeline *Pipeline) skip(stage *Stage) {
+	pipeline.Skipped = append(pipeline.Skipped, stage)
+	if pipeline.SkipFunc != nil {
+		pipeline.SkipFunc(pipeline, stage)
+	}
+}
+
+// shouldRun evaluates the stage's when condition. A condition that renders
+// as empty, or as a false boolean such as "false" or "0", skips the stage.
+func (stage *Stage) shouldRun() (bool, error) {
+	if stage.When == nil {
+		return true, nil
+	}
+	data, err := stage.templateData()
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	if err := stage.When.Execute(&buf, data); err != nil {
+		return false, err
+	}
+	result := strings.TrimSpace(buf.String())
+	if result == "" {
+		return false, nil
+	}
+	if run, err := strconv.ParseBool(result); err == nil {
+		return run, nil
+	}
+	return true, nil
+}
+
+// name describes the stage for logs and job records. Parallel groups are
+// named after their stages.
+func (stage *Stage) name() string {
+	if len(stage.Parallel) == 0 {
+		return stage.Method
+	}
+	names := make([]string, len(stage.Parallel))
+	for i, member := range stage.Parallel {
+		names[i] = member.name()
+	}
+	return "parallel(" + strings.Join(names, ", ") + ")"
+}
+
+// renderArgs executes the stage's arg templates. The stage's Args are replaced
+// with a new map, leaving those of the action untouched.
+func (stage *Stage) renderArgs() error {
+	if len(stage.ArgTemplates) == 0 {
+		return nil
+	}
+	data, err := stage.templateData()
+	if err != nil {
+		return err
+	}
+	args := make(map[string]string, len(stage.Args))
+	for key, value := range stage.Args {
+		args[key] = value
+	}
+	for key, tmpl := range stage.ArgTemplates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+		args[key] = buf.String()
+	}
+	stage.Args = args
+	return nil
+}
+
+// templateData collects the data available to the stage's templates
+func (stage *Stage) templateData() (*StageData, error) {
+	data := &StageData{}
+	switch request := stage.Request.(type) {
+	case *rpc.GuestRequest:
+		data.Guest = request.Guest
+	case *rpc.GuestMetricsRequest:
+		data.Guest = request.Guest
+	}
+	if stage.pipeline != nil {
+		metadata, err := stage.pipeline.hypervisorMetadata()
+		if err != nil {
+			return nil, err
+		}
+		data.Metadata = metadata
+		data.Outputs = stage.pipeline.Outputs
+		if stage.pipeline.err != nil {
+			data.Error = stage.pipeline.err.Error()
+		}
+	}
+	return data, nil
+}
+
+// copyValue returns a pointer to a shallow copy of the value pointed to
+func copyValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return v
+	}
+	c := reflect.New(rv.Elem().Type())
+	c.Elem().Set(rv.Elem())
+	return c.Interface()
+}
+
+// newValue returns a pointer to a new zero value of the type pointed to
+func newValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return v
+	}
+	return reflect.New(rv.Elem().Type()).Interface()
+}
+
+// deepCopy returns a pointer to a deep copy of the value pointed to
+func deepCopy(v interface{}) (interface{}, error) {
+	c := newValue(v)
+	if err := mergeResponse(c, v); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mergeResponse applies a response on top of another the same way decoding it
+// from the sub-agent would have
+func mergeResponse(dst interface{}, src interface{}) error {
+	if dst == nil || src == nil {
+		return nil
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// rollback runs the compensating stages for completed stages in reverse order.
+// A failed compensation does not stop the remaining ones from running.
+// Compensation is not tied to the context of the failed pipeline, so it still
+// runs when that was cancelled or timed out.
+func (pipeline *Pipeline) rollback(completed []completedStage) {
+	for i := len(completed) - 1; i >= 0; i-- {
+		stage := completed[i].stage
+		compensate := stage.Compensate
+		if compensate == nil {
+			continue
+		}
+		record := &StageRollback{
+			Stage:     stage.Method,
+			Index:     completed[i].index,
+			Member:    completed[i].member,
+			Method:    compensate.Method,
+			StartedAt: time.Now(),
+		}
+		if compensate.Service != nil {
+			record.Service = compensate.Service.Name
+		}
+
+		err := pipeline.runCompensation(compensate)
+		record.FinishedAt = time.Now()
+		if err != nil {
+			record.Error = err.Error()
+		}
+		pipeline.Rollbacks = append(pipeline.Rollbacks, record)
+		if pipeline.RollbackFunc != nil {
+			pipeline.RollbackFunc(pipeline, record)
+		}
+	}
+}
+
+// runCompensation runs a compensating stage with the pipeline's stage hooks
+func (pipeline *Pipeline) runCompensation(stage *Stage) error {
+	if err := stage.renderArgs(); err != nil {
+		return err
+	}
+	if pipeline.PreStageFunc != nil {
+		if err := pipeline.PreStageFunc(pipeline, stage); err != nil {
+			return err
+		}
+	}
+	if err := stage.Run(context.Background()); err != nil {
+		return err
+	}
+	if pipeline.PostStageFunc != nil {
+		return pipeline.PostStageFunc(pipeline, stage)
+	}
+	return nil
+}
+
+// instance creates a copy of a stage template for use in a pipeline
+func (stage *Stage) instance(pipeline *Pipeline, request interface{}, response interface{}, rw http.ResponseWriter) *Stage {
+	instance := &Stage{
+		Name:         stage.Name,
+		Service:      stage.Service,
+		Type:         pipeline.Type,
+		Method:       stage.Method,
+		Args:         stage.Args,
+		Retry:        stage.Retry,
+		Timeout:      stage.Timeout,
+		When:         stage.When,
+		ArgTemplates: stage.ArgTemplates,
+		Request:      request,
+		Response:     response,
+		RW:           rw,
+		pipeline:     pipeline,
+	}
+	if stage.Compensate != nil {
+		instance.Compensate = stage.Compensate.instance(pipeline, request, response, rw)
+	}
+	for _, member := range stage.Parallel {
+		instance.Parallel = append(instance.Parallel, member.instance(pipeline, request, response, rw))
+	}
+	return instance
+}
+
 // GeneratePipeline creates an instance of Pipeline based on an action's
 // stages and supplied request & response. It is returned so that any additional
 // modifications (such as adding stage args to requests) can be made before
@@ -81,19 +915,62 @@ func (action *Action) GeneratePipeline(request interface{}, response interface{}
 		ID:       uuid.New(),
 		Action:   action.Name,
 		Type:     action.Type,
+		Priority: action.Priority,
+		Coalesce: action.Coalesce,
 		Stages:   make([]*Stage, len(action.Stages)),
 		DoneChan: done,
+		ctx:      action.ctx,
+		request:  request,
 	}
 	for i, stage := range action.Stages {
-		pipeline.Stages[i] = &Stage{
-			Service:  stage.Service,
-			Type:     action.Type,
-			Method:   stage.Method,
-			Args:     stage.Args,
-			Request:  request,
-			Response: response,
-			RW:       rw,
-		}
+		pipeline.Stages[i] = stage.instance(pipeline, request, response, rw)
 	}
+	pipeline.addHooks(request, response)
 	return pipeline
 }
+
+// actionInfo describes a configured action by name
+func (ctx *Context) actionInfo(name string) (*ActionInfo, error) {
+	cfgAction, ok := ctx.Config.Actions[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &ActionInfo{
+		Name:     name,
+		Type:     cfgAction.Type.String(),
+		Custom:   cfgAction.Custom,
+		Priority: cfgAction.Priority,
+		Recovery: cfgAction.Recovery,
+		Stages:   cfgAction.Stages,
+	}, nil
+}
+
+func listActions(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := getContext(r)
+
+	names := make([]string, 0, len(ctx.Config.Actions))
+	for name := range ctx.Config.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	actions := make([]*ActionInfo, len(names))
+	for i, name := range names {
+		actions[i], _ = ctx.actionInfo(name)
+	}
+	hr.JSON(http.StatusOK, actions)
+}
+
+func getActionInfo(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := getContext(r)
+	vars := mux.Vars(r)
+
+	action, err := ctx.actionInfo(vars["name"])
+	if err != nil {
+		hr.JSONError(http.StatusNotFound, err)
+		return
+	}
+	hr.JSON(http.StatusOK, action)
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/config"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// testStage creates a stage for a guest request, with a when condition if
+// given
+func testStage(t *testing.T, when string, g *client.Guest) *Stage {
+	stage := &Stage{
+		Method:  "Guest.Test",
+		Request: &rpc.GuestRequest{Guest: g},
+	}
+	if when != "" {
+		tmpl, err := config.ParseTemplate("when", when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stage.When = tmpl
+	}
+	return stage
+}
+
+func TestStageShouldRun(t *testing.T) {
+	g := &client.Guest{
+		ID:       "guest",
+		Metadata: map[string]string{"backup": "true", "tier": "gold"},
+	}
+	tests := []struct {
+		when string
+		want bool
+	}{
+		{"", true},
+		{"true", true},
+		{"false", false},
+		{"{{eq (index .Guest.Metadata \"backup\") \"true\"}}", true},
+		{"{{eq (index .Guest.Metadata \"tier\") \"silver\"}}", false},
+		{"{{index .Guest.Metadata \"missing\"}}", false},
+		{" {{.Guest.ID}} ", true},
+		{"{{if .Error}}true{{end}}", false},
+	}
+	for _, test := range tests {
+		run, err := testStage(t, test.when, g).shouldRun()
+		if err != nil {
+			t.Errorf("%q: %s", test.when, err)
+			continue
+		}
+		if run != test.want {
+			t.Errorf("%q: got %t, want %t", test.when, run, test.want)
+		}
+	}
+}
+
+func TestStageShouldRunError(t *testing.T) {
+	stage := testStage(t, "{{.Guest.Missing}}", &client.Guest{})
+	if _, err := stage.shouldRun(); err == nil {
+		t.Error("a when condition that fails to execute should fail")
+	}
+}
+
+func TestStageRenderArgs(t *testing.T) {
+	g := &client.Guest{ID: "guest", Metadata: map[string]string{"owner": "ops"}}
+	pipeline := &Pipeline{
+		Outputs: map[string]interface{}{
+			"define": &rpc.GuestResponse{Guest: &client.Guest{ID: "defined"}},
+		},
+	}
+	stage := testStage(t, "", g)
+	stage.pipeline = pipeline
+	stage.Args = map[string]string{
+		"plain": "value",
+		"owner": "{{index .Guest.Metadata \"owner\"}}",
+		"id":    "{{(index .Outputs \"define\").Guest.ID}}",
+	}
+	stage.ArgTemplates = make(map[string]*template.Template)
+	for _, key := range []string{"owner", "id"} {
+		tmpl, err := config.ParseTemplate(key, stage.Args[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+		stage.ArgTemplates[key] = tmpl
+	}
+	templated := stage.Args
+
+	if err := stage.renderArgs(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"plain": "value", "owner": "ops", "id": "defined"}
+	for key, value := range want {
+		if stage.Args[key] != value {
+			t.Errorf("arg %s = %q, want %q", key, stage.Args[key], value)
+		}
+	}
+	// The stage's original args are left alone
+	if templated["owner"] != "{{index .Guest.Metadata \"owner\"}}" {
+		t.Errorf("original arg owner changed to %q", templated["owner"])
+	}
+}
+
+func TestPipelineRecordOutput(t *testing.T) {
+	pipeline := &Pipeline{}
+	response := &rpc.GuestResponse{Guest: &client.Guest{ID: "guest"}}
+
+	// Unnamed stages are not kept
+	if err := pipeline.recordOutput(&Stage{Method: "Guest.Test", Response: response}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pipeline.Outputs) != 0 {
+		t.Errorf("got outputs %v for an unnamed stage", pipeline.Outputs)
+	}
+
+	if err := pipeline.recordOutput(&Stage{Name: "first", Method: "Guest.Test", Response: response}); err != nil {
+		t.Fatal(err)
+	}
+	// Later changes to the shared response do not affect the output
+	response.Guest.ID = "changed"
+	output, ok := pipeline.Outputs["first"].(*rpc.GuestResponse)
+	if !ok {
+		t.Fatalf("got output %#v", pipeline.Outputs["first"])
+	}
+	if output.Guest.ID != "guest" {
+		t.Errorf("got output guest %q, want guest", output.Guest.ID)
+	}
+}
@@ -0,0 +1,346 @@
+package agent
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mistifyio/kvite"
+	"github.com/mistifyio/mistify-agent/client"
+)
+
+type (
+	// Callback is a URL notified when an async job finishes
+	Callback struct {
+		URL    string
+		Secret string // Signs deliveries if set
+	}
+
+	// CallbackStatus is the delivery status of a callback
+	CallbackStatus string
+
+	// CallbackDelivery tracks the delivery of a callback for a job. The secret
+	// is not recorded.
+	CallbackDelivery struct {
+		URL           string
+		Status        CallbackStatus
+		Attempts      int
+		LastAttemptAt time.Time
+		Error         string // Why the last attempt failed, if it did
+	}
+
+	// CallbackPayload is the body POSTed to a callback URL. Guest is the guest
+	// after the job finished, and is null if the guest no longer exists.
+	CallbackPayload struct {
+		Job   *Job
+		Guest *client.Guest
+	}
+
+	// callbackKey is the request context key for a requested callback
+	callbackKey struct{}
+)
+
+const (
+	// CallbackURLHeader is the request header a client may use to be notified
+	// when the async job started by the request finishes
+	CallbackURLHeader = "X-Callback-URL"
+
+	// CallbackSecretHeader is the request header holding an optional secret
+	// used to sign callback deliveries
+	CallbackSecretHeader = "X-Callback-Secret"
+
+	// CallbackSignatureHeader is set on signed deliveries to "sha256=" and the
+	// hex HMAC-SHA256 of the body, keyed with the callback's secret
+	CallbackSignatureHeader = "X-Callback-Signature"
+
+	// CallbackJobHeader is set on deliveries to the ID of the job
+	CallbackJobHeader = "X-Guest-Job-ID"
+
+	// CallbackPending is the status of a callback not yet delivered
+	CallbackPending CallbackStatus = "Pending"
+	// CallbackDelivered is the status of a delivered callback
+	CallbackDelivered CallbackStatus = "Delivered"
+	// CallbackFailed is the status of a callback that could not be delivered
+	CallbackFailed CallbackStatus = "Failed"
+
+	callbacksBucket = "callbacks"
+
+	// callbackAttempts is how many times delivery is attempted
+	callbackAttempts = 6
+	// callbackBackoff is the wait before the first retry, doubling after each
+	callbackBackoff = 2 * time.Second
+	// callbackTimeout limits each delivery attempt
+	callbackTimeout = 10 * time.Second
+)
+
+var callbackClient = &http.Client{Timeout: callbackTimeout}
+
+// callbackMiddleware applies a client supplied callback for async actions,
+// given by the X-Callback-URL and X-Callback-Secret headers, to the request
+// context. It must run before anything is stored for the request with
+// gorilla/context, since the request is replaced.
+func callbackMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(CallbackURLHeader)
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u, err := url.Parse(value)
+		if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+			err = fmt.Errorf("%q is not an absolute http or https URL", value)
+		}
+		if err != nil {
+			hr := HTTPResponse{w}
+			hr.JSONError(http.StatusBadRequest, fmt.Errorf("invalid %s: %s", CallbackURLHeader, err))
+			return
+		}
+		callback := &Callback{
+			URL:    value,
+			Secret: r.Header.Get(CallbackSecretHeader),
+		}
+		rctx := stdcontext.WithValue(r.Context(), callbackKey{}, callback)
+		h.ServeHTTP(w, r.WithContext(rctx))
+	})
+}
+
+// requestCallback retrieves a client supplied callback from a request context
+func requestCallback(rctx stdcontext.Context) (*Callback, bool) {
+	callback, ok := rctx.Value(callbackKey{}).(*Callback)
+	return callback, ok
+}
+
+// sign returns the signature header value for a body, or "" if the callback
+// has no secret
+func (callback *Callback) sign(body []byte) string {
+	if callback.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(callback.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveCallbacks adds callbacks for a job to those kept until they have been
+// delivered. They are kept apart from the job, since their secrets are needed
+// to sign deliveries but must not be shown. Callbacks are kept in the same
+// order as the job's Callbacks.
+func (ctx *Context) saveCallbacks(jobID string, callbacks []*Callback) error {
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(callbacksBucket)
+		if err != nil {
+			return err
+		}
+		saved, err := getCallbacks(b, jobID)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(append(saved, callbacks...))
+		if err != nil {
+			return err
+		}
+		return b.Put(jobID, data)
+	})
+}
+
+// loadCallbacks retrieves the callbacks kept for a job. Those already
+// delivered, or that failed, are nil.
+func (ctx *Context) loadCallbacks(jobID string) ([]*Callback, error) {
+	var callbacks []*Callback
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(callbacksBucket)
+		if err != nil {
+			return err
+		}
+		callbacks, err = getCallbacks(b, jobID)
+		return err
+	})
+	return callbacks, err
+}
+
+// finishCallback stops keeping a job's callback once its delivery is over,
+// removing the job's callbacks once none are left
+func (ctx *Context) finishCallback(jobID string, i int) error {
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(callbacksBucket)
+		if err != nil {
+			return err
+		}
+		saved, err := getCallbacks(b, jobID)
+		if err != nil || i >= len(saved) {
+			return err
+		}
+		saved[i] = nil
+		for _, callback := range saved {
+			if callback != nil {
+				data, err := json.Marshal(saved)
+				if err != nil {
+					return err
+				}
+				return b.Put(jobID, data)
+			}
+		}
+		return b.Delete(jobID)
+	})
+}
+
+// getCallbacks reads the callbacks kept for a job from the callbacks bucket
+func getCallbacks(b *kvite.Bucket, jobID string) ([]*Callback, error) {
+	var callbacks []*Callback
+	data, err := b.Get(jobID)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &callbacks); err != nil {
+		return nil, err
+	}
+	return callbacks, nil
+}
+
+// deliverCallbacks notifies a finished job's callbacks that are still pending
+// in the background. Deliveries resumed after a restart carry on counting
+// attempts from where they were.
+func (ctx *Context) deliverCallbacks(guestID, jobID string) {
+	callbacks, err := ctx.loadCallbacks(jobID)
+	if err != nil {
+		LogRunnerError(guestID, "callback", jobID, err.Error())
+		return
+	}
+	if len(callbacks) == 0 {
+		return
+	}
+	job, err := ctx.JobLog.GetJob(jobID)
+	if err != nil {
+		LogRunnerError(guestID, "callback", jobID, err.Error())
+		return
+	}
+	payload := &CallbackPayload{Job: job}
+	if g, err := ctx.GetGuest(guestID); err == nil {
+		payload.Guest = g
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		LogRunnerError(guestID, "callback", jobID, err.Error())
+		return
+	}
+
+	ctx.JobLog.ModifyMutex.RLock()
+	deliveries := make([]CallbackDelivery, len(job.Callbacks))
+	for i, delivery := range job.Callbacks {
+		deliveries[i] = *delivery
+	}
+	ctx.JobLog.ModifyMutex.RUnlock()
+	for i, callback := range callbacks {
+		if callback == nil {
+			continue
+		}
+		if i >= len(deliveries) || deliveries[i].Status != CallbackPending {
+			// The delivery finished before the callback could be forgotten
+			if err := ctx.finishCallback(jobID, i); err != nil {
+				LogRunnerError(guestID, "callback", jobID, err.Error())
+			}
+			continue
+		}
+		go ctx.deliverCallback(guestID, jobID, i, deliveries[i].Attempts+1, callback, body)
+	}
+}
+
+// deliverCallback POSTs a job's callback body to a callback URL, retrying with
+// backoff until it is accepted with a 2xx status or the attempts run out. At
+// least one attempt is made, starting from the given attempt number. The
+// delivery is recorded on the job as the callback at index i, and the callback
+// is forgotten once delivery is over.
+func (ctx *Context) deliverCallback(guestID, jobID string, i, first int, callback *Callback, body []byte) {
+	backoff := callbackBackoff
+	for attempt := first; ; attempt++ {
+		delivery := &CallbackDelivery{
+			URL:           callback.URL,
+			Status:        CallbackDelivered,
+			Attempts:      attempt,
+			LastAttemptAt: time.Now(),
+		}
+		err := postCallback(jobID, callback, body)
+		if err != nil {
+			delivery.Status = CallbackPending
+			if attempt >= callbackAttempts {
+				delivery.Status = CallbackFailed
+			}
+			delivery.Error = err.Error()
+		}
+		if err := ctx.JobLog.UpdateCallback(jobID, i, delivery); err != nil {
+			LogRunnerError(guestID, "callback", jobID, err.Error())
+		}
+		if delivery.Status != CallbackPending {
+			if err := ctx.finishCallback(jobID, i); err != nil {
+				LogRunnerError(guestID, "callback", jobID, err.Error())
+			}
+		}
+		if err == nil {
+			LogRunnerInfo(guestID, "callback", jobID, "Delivered to "+callback.URL)
+			return
+		}
+		LogRunnerError(guestID, "callback", jobID, err.Error())
+		if delivery.Status == CallbackFailed {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postCallback makes one delivery attempt
+func postCallback(jobID string, callback *Callback, body []byte) error {
+	req, err := http.NewRequest("POST", callback.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CallbackJobHeader, jobID)
+	if signature := callback.sign(body); signature != "" {
+		req.Header.Set(CallbackSignatureHeader, signature)
+	}
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback %s returned %s", callback.URL, resp.Status)
+	}
+	return nil
+}
+
+// resumeCallbacks carries on delivering the callbacks of finished jobs that
+// were still pending when the agent stopped, including those of jobs that were
+// interrupted. A pending callback that is no longer kept cannot be delivered
+// and is marked as failed. Must be called after interrupted jobs are marked
+// and before any queued actions are restored.
+func (ctx *Context) resumeCallbacks() error {
+	for _, job := range ctx.JobLog.getJobsWithPendingCallbacks() {
+		callbacks, err := ctx.loadCallbacks(job.ID)
+		if err != nil {
+			return err
+		}
+		for i, delivery := range job.Callbacks {
+			if delivery.Status != CallbackPending || (i < len(callbacks) && callbacks[i] != nil) {
+				continue
+			}
+			failed := *delivery
+			failed.Status = CallbackFailed
+			failed.Error = "callback was lost before it could be delivered"
+			if err := ctx.JobLog.UpdateCallback(job.ID, i, &failed); err != nil {
+				return err
+			}
+		}
+		LogRunnerInfo(job.GuestID, "callback", job.ID, "Resuming delivery")
+		ctx.deliverCallbacks(job.GuestID, job.ID)
+	}
+	return nil
+}
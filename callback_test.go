@@ -0,0 +1,24 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestCallbackSign(t *testing.T) {
+	body := []byte(`{"Job":{"ID":"job"}}`)
+
+	unsigned := &Callback{URL: "http://example.com/hook"}
+	if got := unsigned.sign(body); got != "" {
+		t.Errorf("callback without a secret signed as %q", got)
+	}
+
+	// echo -n '{"Job":{"ID":"job"}}' | openssl dgst -sha256 -hmac secret
+	signed := &Callback{URL: "http://example.com/hook", Secret: "secret"}
+	want := "sha256=2fe486c7af6c1c585ccbb4f664eeb3e7c70b79a4270bc58b330c83e8d923920c"
+	if got := signed.sign(body); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if other := (&Callback{Secret: "other"}).sign(body); other == want {
+		t.Error("a different secret gave the same signature")
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+	"time"
 )
 
 type (
@@ -17,26 +21,88 @@ type (
 		MaxPending uint   `json:"max_pending"`
 		Port       uint   `json:"port"`
 		Path       string `json:"path"`
+		Timeout    uint   `json:"timeout"` // Seconds allowed for a single call
+	}
+
+	// RetryPolicy controls how a failed stage is retried
+	RetryPolicy struct {
+		MaxAttempts uint     `json:"max_attempts"` // Total attempts, including the first
+		Backoff     uint     `json:"backoff"`      // Seconds to wait before the first retry
+		MaxBackoff  uint     `json:"max_backoff"`  // Upper limit for the doubling backoff, in seconds
+		RetryOn     []string `json:"retry_on"`     // Error classes that should be retried
 	}
 
 	// Stage is a single step for an action
 	Stage struct {
-		Service string            `json:"service"`
-		Method  string            `json:"method"`
-		Args    map[string]string `json:"args"`
+		Name       string            `json:"name"` // Key for the stage's response in later stages' templates
+		Service    string            `json:"service"`
+		Method     string            `json:"method"`
+		Args       map[string]string `json:"args"`
+		Retry      RetryPolicy       `json:"retry"`
+		Timeout    uint              `json:"timeout"`    // Seconds allowed for the stage, including retries
+		Compensate *Stage            `json:"compensate"` // Undoes the stage if a later stage fails
+		Parallel   []Stage           `json:"parallel"`   // Stages to run concurrently in place of this one
+		When       string            `json:"when"`       // Template condition for running the stage
 	}
 
-	// Action is a set of stages and how they should be handled
+	// Action is a set of stages and how they should be handled. Custom actions,
+	// those not in ValidActions, must name their type.
 	Action struct {
-		Type   ActionType
-		Stages []Stage `json:"stages"`
+		Type     ActionType `json:"-"`
+		TypeName string     `json:"type"` // info, stream, or async
+		Custom   bool       `json:"-"`
+		Priority int        `json:"priority"` // Queued async actions with higher priorities run first
+		Coalesce bool       `json:"coalesce"` // Merge into an identical queued async action
+		Recovery string     `json:"recovery"` // Run if the action was interrupted by a restart
+		Stages   []Stage    `json:"stages"`
+	}
+
+	// Hook is a set of stages run around every action matching one of its
+	// patterns. Hook stages cannot change the outcome of the action.
+	Hook struct {
+		Actions []string `json:"actions"` // Action name patterns, matching all async actions if empty
+		// AllTypes makes a hook without patterns match info and stream
+		// actions too
+		AllTypes bool    `json:"all_types"`
+		Before   []Stage `json:"before"`  // Run before the action's stages
+		Success  []Stage `json:"success"` // Run after the action succeeds
+		Failure  []Stage `json:"failure"` // Run after the action fails
+		// Timeout is the seconds allowed for each stage that does not set its
+		// own, defaulting to 30
+		Timeout uint `json:"timeout"`
+	}
+
+	// JobRetention controls how long jobs are kept in the job log, and where
+	// pruned jobs are archived. Active jobs are never pruned. The limits are
+	// nil if not set, and 0 for no limit, so that a config can remove a limit
+	// set by another.
+	JobRetention struct {
+		MaxJobs      *uint `json:"max_jobs"`       // Jobs kept across all guests
+		MaxGuestJobs *uint `json:"max_guest_jobs"` // Jobs kept for each guest
+		MaxAge       *uint `json:"max_age"`        // Seconds a finished job is kept
+		// ArchiveDir is where pruned jobs are archived as compressed JSON
+		// Lines. Pruned jobs are discarded if it is not set.
+		ArchiveDir      string `json:"archive_dir"`
+		ArchiveMaxSize  uint   `json:"archive_max_size"`  // Bytes written to an archive file before rotating it
+		ArchiveMaxFiles uint   `json:"archive_max_files"` // Archive files kept, including the current one
 	}
 
 	// Config contains all of the configuration data
 	Config struct {
 		Actions  map[string]Action  `json:"actions"`
 		Services map[string]Service `json:"services"`
+		Hooks    []Hook             `json:"hooks"`
 		DBPath   string             `json:"dbpath"`
+		// IdempotencyWindow is how long, in seconds, the response to a request
+		// with an Idempotency-Key is kept for replaying
+		IdempotencyWindow uint `json:"idempotency_window"`
+		// MaxQueued is how many async actions may be queued for a guest
+		// before more are rejected. Guests may override it in their metadata.
+		MaxQueued uint `json:"max_queued"`
+		// QueuedOnRestart is what happens to async actions that were still
+		// queued when the agent stopped: "resume" or "fail"
+		QueuedOnRestart string       `json:"queued_on_restart"`
+		JobRetention    JobRetention `json:"job_retention"`
 	}
 )
 
@@ -49,8 +115,31 @@ const (
 	AsyncAction
 )
 
+const (
+	// RetryTransport retries when a sub-agent could not be reached
+	RetryTransport = "transport"
+	// RetryStatus retries when a sub-agent responds with an HTTP error status
+	RetryStatus = "status"
+	// RetryRPC retries when a sub-agent method returns an error
+	RetryRPC = "rpc"
+	// RetryTimeout retries when a single call exceeds its service's timeout
+	RetryTimeout = "timeout"
+)
+
+// CompensateRecovery is the recovery for an interrupted action that runs the
+// compensating stages of the stages it completed
+const CompensateRecovery = "compensate"
+
+const (
+	// ResumeQueued queues actions left queued by a restart again
+	ResumeQueued = "resume"
+	// FailQueued fails the jobs of actions left queued by a restart
+	FailQueued = "fail"
+)
+
 var (
-	// ValidActions is a whitelist of configurable actions and their types
+	// ValidActions are the built-in actions and their types. Other actions
+	// may be configured as custom actions.
 	ValidActions = map[string]ActionType{
 		"create":               AsyncAction,
 		"containerCreate":      AsyncAction,
@@ -86,27 +175,266 @@ var (
 	}
 )
 
+// actionTypeNames are the configurable names of the action types
+var actionTypeNames = map[ActionType]string{
+	InfoAction:   "info",
+	StreamAction: "stream",
+	AsyncAction:  "async",
+}
+
+// String returns the name of the action type
+func (t ActionType) String() string {
+	if name, ok := actionTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ActionType(%d)", int(t))
+}
+
+// ParseActionType looks up an action type by name
+func ParseActionType(name string) (ActionType, error) {
+	for t, n := range actionTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action type %s", name)
+}
+
 // NewConfig creates a new Config
 func NewConfig() *Config {
 	c := &Config{
 		Actions:  make(map[string]Action),
 		Services: make(map[string]Service),
 		DBPath:   "/tmp/mistify-agent.db",
+
+		IdempotencyWindow: 24 * 60 * 60,
+		MaxQueued:         100,
+		QueuedOnRestart:   ResumeQueued,
+		JobRetention: JobRetention{
+			MaxJobs:         newUint(1000),
+			ArchiveMaxSize:  10 * 1024 * 1024,
+			ArchiveMaxFiles: 10,
+		},
 	}
 
 	return c
 }
 
+// ParseTemplate parses a stage template, such as a when condition or an arg
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Parse(text)
+}
+
+// IsTemplate reports whether a stage arg value contains template actions
+func IsTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
 func (stage *Stage) validate(prefix string) error {
 	if stage == nil {
 		return nil
 	}
+	if len(stage.Parallel) > 0 {
+		return stage.validateGroup(prefix)
+	}
 	if stage.Method == "" {
 		return fmt.Errorf("%s: method cannot be empty", prefix)
 	}
 	if stage.Service == "" {
 		return fmt.Errorf("%s: service cannot be empty", prefix)
 	}
+	if stage.Compensate != nil {
+		// The compensating stage defaults to the same service
+		if stage.Compensate.Service == "" {
+			stage.Compensate.Service = stage.Service
+		}
+		if stage.Compensate.Compensate != nil {
+			return fmt.Errorf("%s: compensating stage cannot have its own compensation", prefix)
+		}
+		if len(stage.Compensate.Parallel) > 0 {
+			return fmt.Errorf("%s: compensating stage cannot be a parallel group", prefix)
+		}
+		if stage.Compensate.When != "" {
+			return fmt.Errorf("%s: compensating stage cannot have a when condition", prefix)
+		}
+		if err := stage.Compensate.validate(prefix + " compensate"); err != nil {
+			return err
+		}
+	}
+	if err := stage.Retry.validate(prefix); err != nil {
+		return err
+	}
+	stage.Retry.setDefaults()
+	return nil
+}
+
+// validateStageNames checks that the named stages of an action, including the
+// stages of parallel groups, have unique names
+func validateStageNames(prefix string, stages []Stage) error {
+	names := make(map[string]bool)
+	var check func(stages []Stage) error
+	check = func(stages []Stage) error {
+		for _, stage := range stages {
+			if stage.Name != "" {
+				if names[stage.Name] {
+					return fmt.Errorf("%s: stage name %s is used more than once", prefix, stage.Name)
+				}
+				names[stage.Name] = true
+			}
+			if err := check(stage.Parallel); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(stages)
+}
+
+// validateGroup checks a stage that is a group of parallel stages. Settings
+// that only make sense for a single call belong on the group's stages instead.
+func (stage *Stage) validateGroup(prefix string) error {
+	if stage.Service != "" || stage.Method != "" {
+		return fmt.Errorf("%s: parallel group cannot have a service or method", prefix)
+	}
+	if stage.Compensate != nil {
+		return fmt.Errorf("%s: parallel group cannot have a compensating stage", prefix)
+	}
+	if stage.Retry.MaxAttempts != 0 || len(stage.Retry.RetryOn) != 0 {
+		return fmt.Errorf("%s: parallel group cannot have a retry policy", prefix)
+	}
+	for i := range stage.Parallel {
+		member := &stage.Parallel[i]
+		if len(member.Parallel) > 0 {
+			return fmt.Errorf("%s: parallel groups cannot be nested", prefix)
+		}
+		if err := member.validate(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rp *RetryPolicy) validate(prefix string) error {
+	for _, class := range rp.RetryOn {
+		switch class {
+		case RetryTransport, RetryStatus, RetryRPC, RetryTimeout:
+		default:
+			return fmt.Errorf("%s: unknown retry class %s", prefix, class)
+		}
+	}
+	if rp.MaxBackoff != 0 && rp.MaxBackoff < rp.Backoff {
+		return fmt.Errorf("%s: max_backoff cannot be less than backoff", prefix)
+	}
+	return nil
+}
+
+// setDefaults fills in unset retry values. A stage is attempted once unless
+// configured otherwise.
+func (rp *RetryPolicy) setDefaults() {
+	if rp.MaxAttempts == 0 {
+		rp.MaxAttempts = 1
+	}
+	if rp.Backoff == 0 {
+		rp.Backoff = 1
+	}
+	if len(rp.RetryOn) == 0 {
+		rp.RetryOn = []string{RetryTransport}
+	}
+}
+
+// Retries reports whether errors of the given class should be retried
+func (rp *RetryPolicy) Retries(class string) bool {
+	for _, c := range rp.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait before the given retry, starting at 1. The
+// backoff doubles with each retry, up to MaxBackoff if set.
+func (rp *RetryPolicy) Delay(retry uint) time.Duration {
+	delay := rp.Backoff
+	for i := uint(1); i < retry; i++ {
+		delay *= 2
+		if rp.MaxBackoff != 0 && delay >= rp.MaxBackoff {
+			break
+		}
+	}
+	if rp.MaxBackoff != 0 && delay > rp.MaxBackoff {
+		delay = rp.MaxBackoff
+	}
+	return time.Duration(delay) * time.Second
+}
+
+// setType works out the type of an action. Actions in ValidActions have a fixed
+// type, while custom actions must name theirs.
+func (action *Action) setType(name string) error {
+	if t, ok := ValidActions[name]; ok {
+		if action.TypeName != "" && action.TypeName != t.String() {
+			return fmt.Errorf("action %s must be of type %s", name, t)
+		}
+		action.Type = t
+		action.TypeName = t.String()
+		return nil
+	}
+	if action.TypeName == "" {
+		return fmt.Errorf("custom action %s must have a type", name)
+	}
+	t, err := ParseActionType(action.TypeName)
+	if err != nil {
+		return fmt.Errorf("action %s: %s", name, err)
+	}
+	action.Type = t
+	action.Custom = true
+	return nil
+}
+
+// Matches reports whether the hook applies to an action. Patterns use the
+// syntax of path.Match, such as "container*". A hook without patterns matches
+// every async action, and every action if AllTypes is set.
+func (hook *Hook) Matches(action string, actionType ActionType) bool {
+	if len(hook.Actions) == 0 {
+		return hook.AllTypes || actionType == AsyncAction
+	}
+	for _, pattern := range hook.Actions {
+		if ok, _ := path.Match(pattern, action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stages returns the hook's stages along with a name for each kind
+func (hook *Hook) stages() map[string][]Stage {
+	return map[string][]Stage{
+		"before":  hook.Before,
+		"success": hook.Success,
+		"failure": hook.Failure,
+	}
+}
+
+func (hook *Hook) validate(prefix string) error {
+	for _, pattern := range hook.Actions {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid action pattern %s", prefix, pattern)
+		}
+	}
+	for kind, stages := range hook.stages() {
+		for i := range stages {
+			s := &stages[i]
+			if len(s.Parallel) > 0 {
+				return fmt.Errorf("%s %s: hook stage cannot be a parallel group", prefix, kind)
+			}
+			if s.Compensate != nil {
+				return fmt.Errorf("%s %s: hook stage cannot have a compensating stage", prefix, kind)
+			}
+			if err := s.validate(prefix + " " + kind); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -142,32 +470,72 @@ func (c *Config) AddConfig(path string) error {
 		if _, ok := c.Actions[name]; ok {
 			return fmt.Errorf("action %s has already been defined", name)
 		}
-		if _, ok := ValidActions[name]; !ok {
-			return fmt.Errorf("action %s is not a valid action", name)
+		if err := action.setType(name); err != nil {
+			return err
 		}
 
-		for _, s := range action.Stages {
+		for i := range action.Stages {
+			s := &action.Stages[i]
 			if err := s.validate(name); err != nil {
 				return err
 			}
 		}
+		if err := validateStageNames(name, action.Stages); err != nil {
+			return err
+		}
 
-		action.Type = ValidActions[name]
 		c.Actions[name] = action
 	}
 
+	if newConfig.IdempotencyWindow != 0 {
+		c.IdempotencyWindow = newConfig.IdempotencyWindow
+	}
+	if newConfig.MaxQueued != 0 {
+		c.MaxQueued = newConfig.MaxQueued
+	}
+	switch newConfig.QueuedOnRestart {
+	case "":
+	case ResumeQueued, FailQueued:
+		c.QueuedOnRestart = newConfig.QueuedOnRestart
+	default:
+		return fmt.Errorf("unknown queued_on_restart %s", newConfig.QueuedOnRestart)
+	}
+	c.JobRetention.merge(&newConfig.JobRetention)
+
+	for i := range newConfig.Hooks {
+		hook := &newConfig.Hooks[i]
+		if err := hook.validate(fmt.Sprintf("hook %d", len(c.Hooks))); err != nil {
+			return err
+		}
+		c.Hooks = append(c.Hooks, *hook)
+	}
+
 	return nil
 }
 
 // Fixup does a bit of validation and initializtion
 func (c *Config) Fixup() error {
 	for name, action := range c.Actions {
-		for _, stage := range action.Stages {
-			if _, ok := c.Services[stage.Service]; !ok {
-				return fmt.Errorf("%s unable to find service %s", name, stage.Service)
+		for i := range action.Stages {
+			if err := c.fixupStage(name, &action.Stages[i]); err != nil {
+				return err
 			}
-			if stage.Args == nil {
-				stage.Args = make(map[string]string)
+		}
+	}
+
+	for name, action := range c.Actions {
+		if err := c.validateRecovery(name, action); err != nil {
+			return err
+		}
+	}
+
+	for i := range c.Hooks {
+		name := fmt.Sprintf("hook %d", i)
+		for kind, stages := range c.Hooks[i].stages() {
+			for j := range stages {
+				if err := c.fixupStage(name+" "+kind, &stages[j]); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -176,3 +544,97 @@ func (c *Config) Fixup() error {
 
 	return nil
 }
+
+// validateRecovery checks the recovery of an action interrupted by a restart,
+// which must either compensate or name another async action
+func (c *Config) validateRecovery(name string, action Action) error {
+	if action.Recovery == "" {
+		return nil
+	}
+	if action.Type != AsyncAction {
+		return fmt.Errorf("%s: only async actions can have a recovery", name)
+	}
+	if action.Recovery == CompensateRecovery {
+		return nil
+	}
+	recovery, ok := c.Actions[action.Recovery]
+	if !ok {
+		return fmt.Errorf("%s: unable to find recovery action %s", name, action.Recovery)
+	}
+	if recovery.Type != AsyncAction {
+		return fmt.Errorf("%s: recovery action %s must be async", name, action.Recovery)
+	}
+	return nil
+}
+
+// fixupStage checks that a stage's services exist and its templates parse,
+// and initializes its args
+func (c *Config) fixupStage(name string, stage *Stage) error {
+	if stage.When != "" {
+		if _, err := ParseTemplate(name+" when", stage.When); err != nil {
+			return fmt.Errorf("%s: invalid when: %s", name, err)
+		}
+	}
+	for i := range stage.Parallel {
+		if err := c.fixupStage(name, &stage.Parallel[i]); err != nil {
+			return err
+		}
+	}
+	if len(stage.Parallel) > 0 {
+		return nil
+	}
+	if _, ok := c.Services[stage.Service]; !ok {
+		return fmt.Errorf("%s unable to find service %s", name, stage.Service)
+	}
+	if stage.Compensate != nil {
+		if err := c.fixupStage(name, stage.Compensate); err != nil {
+			return err
+		}
+	}
+	if stage.Args == nil {
+		stage.Args = make(map[string]string)
+	}
+	for key, value := range stage.Args {
+		if !IsTemplate(value) {
+			continue
+		}
+		if _, err := ParseTemplate(name+" "+key, value); err != nil {
+			return fmt.Errorf("%s: invalid template for arg %s: %s", name, key, err)
+		}
+	}
+	return nil
+}
+
+// merge overrides retention settings with those set in another config
+func (r *JobRetention) merge(newRetention *JobRetention) {
+	if newRetention.MaxJobs != nil {
+		r.MaxJobs = newRetention.MaxJobs
+	}
+	if newRetention.MaxGuestJobs != nil {
+		r.MaxGuestJobs = newRetention.MaxGuestJobs
+	}
+	if newRetention.MaxAge != nil {
+		r.MaxAge = newRetention.MaxAge
+	}
+	if newRetention.ArchiveDir != "" {
+		r.ArchiveDir = newRetention.ArchiveDir
+	}
+	if newRetention.ArchiveMaxSize != 0 {
+		r.ArchiveMaxSize = newRetention.ArchiveMaxSize
+	}
+	if newRetention.ArchiveMaxFiles != 0 {
+		r.ArchiveMaxFiles = newRetention.ArchiveMaxFiles
+	}
+}
+
+// Limit returns the value of a retention limit, or 0 if there is no limit
+func Limit(limit *uint) uint {
+	if limit == nil {
+		return 0
+	}
+	return *limit
+}
+
+func newUint(value uint) *uint {
+	return &value
+}
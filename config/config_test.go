@@ -0,0 +1,75 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	rp := &RetryPolicy{}
+	rp.setDefaults()
+	if rp.MaxAttempts != 1 || rp.Backoff != 1 {
+		t.Errorf("got max attempts %d and backoff %d, want 1 and 1", rp.MaxAttempts, rp.Backoff)
+	}
+	if !rp.Retries(RetryTransport) || rp.Retries(RetryStatus) {
+		t.Errorf("got retry classes %v, want only %s", rp.RetryOn, RetryTransport)
+	}
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	rp := &RetryPolicy{RetryOn: []string{RetryStatus, RetryTimeout}}
+	for class, want := range map[string]bool{
+		RetryTransport: false,
+		RetryStatus:    true,
+		RetryRPC:       false,
+		RetryTimeout:   true,
+	} {
+		if got := rp.Retries(class); got != want {
+			t.Errorf("Retries(%s) = %t, want %t", class, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		backoff    uint
+		maxBackoff uint
+		want       []uint // Seconds before retries 1, 2, ...
+	}{
+		{1, 0, []uint{1, 2, 4, 8, 16}},
+		{3, 0, []uint{3, 6, 12}},
+		{1, 5, []uint{1, 2, 4, 5, 5, 5}},
+		{2, 2, []uint{2, 2, 2}},
+	}
+	for _, test := range tests {
+		rp := &RetryPolicy{Backoff: test.backoff, MaxBackoff: test.maxBackoff}
+		for i, want := range test.want {
+			retry := uint(i + 1)
+			if got := rp.Delay(retry); got != time.Duration(want)*time.Second {
+				t.Errorf("backoff %d, max %d: Delay(%d) = %s, want %ds", test.backoff, test.maxBackoff, retry, got, want)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := []RetryPolicy{
+		{},
+		{RetryOn: []string{RetryTransport, RetryStatus, RetryRPC, RetryTimeout}},
+		{Backoff: 2, MaxBackoff: 2},
+	}
+	for _, rp := range valid {
+		if err := rp.validate("stage"); err != nil {
+			t.Errorf("%+v: %s", rp, err)
+		}
+	}
+	invalid := []RetryPolicy{
+		{RetryOn: []string{"sometimes"}},
+		{Backoff: 5, MaxBackoff: 2},
+	}
+	for _, rp := range invalid {
+		if err := rp.validate("stage"); err == nil {
+			t.Errorf("%+v should be invalid", rp)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"text/template"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -20,20 +21,37 @@ type (
 		Config   *config.Config
 		Actions  map[string]*Action
 		Services map[string]*Service
+		Hooks    []*Hook
 
 		GuestRunners     map[string]*GuestRunner
 		GuestRunnerMutex sync.Mutex
 		JobLog           *JobLog
+		Events           *EventBus
+
+		idempotencyKeys  map[string]bool // Keys of requests in progress
+		idempotencyMutex sync.Mutex
+
+		scheduleMutex sync.Mutex    // Serializes changes to schedules
+		scheduleChan  chan struct{} // Wakes the scheduler when schedules change
+
+		archiveMutex sync.Mutex // Serializes access to the job archive files
+
+		jobOutputs *jobOutputs // Log lines of active jobs
 	}
 )
 
 // NewContext creates a new context. In general, there should only be one.
 func NewContext(cfg *config.Config) (*Context, error) {
 	ctx := &Context{
-		Config:   cfg,
-		Actions:  make(map[string]*Action),
-		Services: make(map[string]*Service),
+		Config:          cfg,
+		Actions:         make(map[string]*Action),
+		Services:        make(map[string]*Service),
+		idempotencyKeys: make(map[string]bool),
+		scheduleChan:    make(chan struct{}, 1),
+		Events:          NewEventBus(),
+		jobOutputs:      &jobOutputs{outputs: make(map[string]*jobOutput)},
 	}
+	log.AddHook(ctx.jobOutputs)
 
 	db, err := kvite.Open(cfg.DBPath, "mistify_agent")
 	if err != nil {
@@ -45,7 +63,8 @@ func NewContext(cfg *config.Config) (*Context, error) {
 	}
 
 	for name, service := range cfg.Services {
-		ctx.Services[name], err = ctx.NewService(name, service.Port, service.Path, service.MaxPending)
+		timeout := time.Duration(service.Timeout) * time.Second
+		ctx.Services[name], err = ctx.NewService(name, service.Port, service.Path, service.MaxPending, timeout)
 		if err != nil {
 			return nil, err
 		}
@@ -54,23 +73,34 @@ func NewContext(cfg *config.Config) (*Context, error) {
 	for name, cfgAction := range cfg.Actions {
 
 		action := &Action{
-			Name:   name,
-			Type:   cfgAction.Type,
-			Stages: make([]*Stage, len(cfgAction.Stages)),
+			Name:     name,
+			Type:     cfgAction.Type,
+			Custom:   cfgAction.Custom,
+			Priority: cfgAction.Priority,
+			Coalesce: cfgAction.Coalesce,
+			Recovery: cfgAction.Recovery,
+			Stages:   make([]*Stage, len(cfgAction.Stages)),
+			ctx:      ctx,
 		}
 
 		for i, stage := range cfgAction.Stages {
-			action.Stages[i] = &Stage{
-				Service: ctx.Services[stage.Service],
-				Type:    action.Type,
-				Method:  stage.Method,
-				Args:    stage.Args,
+			action.Stages[i], err = ctx.newStage(action.Type, stage)
+			if err != nil {
+				return nil, err
 			}
 		}
 
 		ctx.Actions[name] = action
 	}
 
+	for _, cfgHook := range cfg.Hooks {
+		hook, err := ctx.newHook(cfgHook)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Hooks = append(ctx.Hooks, hook)
+	}
+
 	ctx.GuestRunners = make(map[string]*GuestRunner)
 
 	log.WithFields(log.Fields{
@@ -80,6 +110,54 @@ func NewContext(cfg *config.Config) (*Context, error) {
 	return ctx, nil
 }
 
+// newStage creates a stage template from its configuration
+func (ctx *Context) newStage(actionType config.ActionType, cfgStage config.Stage) (*Stage, error) {
+	stage := &Stage{
+		Name:    cfgStage.Name,
+		Service: ctx.Services[cfgStage.Service],
+		Type:    actionType,
+		Method:  cfgStage.Method,
+		Args:    cfgStage.Args,
+		Retry:   cfgStage.Retry,
+		Timeout: time.Duration(cfgStage.Timeout) * time.Second,
+	}
+	if cfgStage.When != "" {
+		when, err := config.ParseTemplate(cfgStage.Method+" when", cfgStage.When)
+		if err != nil {
+			return nil, err
+		}
+		stage.When = when
+	}
+	for key, value := range cfgStage.Args {
+		if !config.IsTemplate(value) {
+			continue
+		}
+		tmpl, err := config.ParseTemplate(cfgStage.Method+" "+key, value)
+		if err != nil {
+			return nil, err
+		}
+		if stage.ArgTemplates == nil {
+			stage.ArgTemplates = make(map[string]*template.Template)
+		}
+		stage.ArgTemplates[key] = tmpl
+	}
+	if cfgStage.Compensate != nil {
+		compensate, err := ctx.newStage(actionType, *cfgStage.Compensate)
+		if err != nil {
+			return nil, err
+		}
+		stage.Compensate = compensate
+	}
+	for _, cfgMember := range cfgStage.Parallel {
+		member, err := ctx.newStage(actionType, cfgMember)
+		if err != nil {
+			return nil, err
+		}
+		stage.Parallel = append(stage.Parallel, member)
+	}
+	return stage, nil
+}
+
 // GetAction looks up an action by name
 func (ctx *Context) GetAction(name string) (*Action, error) {
 	action, ok := ctx.Actions[name]
@@ -113,13 +191,16 @@ func (ctx *Context) GetGuest(id string) (*client.Guest, error) {
 	return &g, nil
 }
 
-// RunGuests creates and runs helpers for each defined guest. In general, this should only be called early in a process
+// RunGuests creates and runs helpers for each defined guest, then deals with
+// any async actions left running or queued when the agent last stopped and
+// starts the scheduler. In general, this should only be called early in a
+// process, after the job log is created and before the HTTP API is started.
 // There is no locking provided.
 func (ctx *Context) RunGuests() error {
 	// Runner for agent-level jobs, like image fetching
-	_ = ctx.NewGuestRunner("agent", 100, 5)
+	_ = ctx.NewGuestRunner("agent", 100, 5, ctx.Config.MaxQueued)
 
-	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
 		b, err := tx.Bucket("guests")
 		if err != nil {
 			return err
@@ -130,30 +211,44 @@ func (ctx *Context) RunGuests() error {
 				// should this be fatal if it just fails on one guest??
 				return err
 			}
-			_ = ctx.NewGuestRunner(guest.ID, 100, 5)
+			_ = ctx.NewGuestRunner(guest.ID, 100, 5, ctx.maxQueued(&guest))
 			return nil
 		})
 	})
+	if err != nil {
+		return err
+	}
+	if err := ctx.recoverInterrupted(); err != nil {
+		return err
+	}
+	if err := ctx.resumeCallbacks(); err != nil {
+		return err
+	}
+	if err := ctx.restoreQueued(); err != nil {
+		return err
+	}
+	go ctx.runScheduler()
+	return nil
 }
 
 // CreateJobLog creates a new job log
 func (ctx *Context) CreateJobLog() error {
 	// Attempt to load from database
 	jobLog, err := ctx.GetJobLog()
-	if err == nil {
-		ctx.JobLog = jobLog
-		return nil
+	if err == ErrNotFound {
+		// Create a new one
+		jobLog = &JobLog{
+			Context:    ctx,
+			Index:      make(map[string]int),
+			GuestIndex: make(map[string][]int),
+			Jobs:       make([]*Job, 0, config.Limit(ctx.Config.JobRetention.MaxJobs)+1),
+		}
+		err = nil
 	}
-	if err != ErrNotFound {
+	if err != nil {
 		return err
 	}
-	// Create a new one
-	ctx.JobLog = &JobLog{
-		Context:    ctx,
-		Index:      make(map[string]int),
-		GuestIndex: make(map[string][]int),
-		Jobs:       make([]*Job, 0, MaxLoggedJobs+1),
-	}
+	ctx.JobLog = jobLog
 
 	go func() {
 		for {
@@ -171,12 +266,12 @@ func (ctx *Context) GetJobLog() (*JobLog, error) {
 		Context: ctx,
 	}
 	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
-		b, err := tx.Bucket("joblog")
+		b, err := tx.Bucket("guest_jobs")
 		if err != nil {
 			return err
 		}
 
-		data, err := b.Get("jobs")
+		data, err := b.Get(jobLog.GuestID)
 		if err != nil {
 			return err
 		}
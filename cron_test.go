@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	specs := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@often",
+	}
+	for _, spec := range specs {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) should fail", spec)
+		}
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field  string
+		min    int
+		max    int
+		values []int
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"3", 0, 5, []int{3}},
+		{"1-3", 0, 5, []int{1, 2, 3}},
+		{"1,4", 0, 5, []int{1, 4}},
+		{"*/2", 0, 5, []int{0, 2, 4}},
+		{"1-5/2", 0, 5, []int{1, 3, 5}},
+		{"2/3", 0, 10, []int{2, 5, 8}},
+		{"0,3-4", 0, 5, []int{0, 3, 4}},
+	}
+	for _, test := range tests {
+		field, err := parseCronField(test.field, test.min, test.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q) failed: %s", test.field, err)
+			continue
+		}
+		var want cronField
+		for _, v := range test.values {
+			want |= 1 << uint(v)
+		}
+		if field != want {
+			t.Errorf("parseCronField(%q) = %b, want %b", test.field, field, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Sunday
+	start := time.Date(2016, time.October, 16, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2016, time.October, 16, 10, 31, 0, 0, time.UTC)},
+		{"30 * * * *", time.Date(2016, time.October, 16, 11, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2016, time.October, 16, 10, 45, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, time.October, 16, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2016, time.October, 17, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2016, time.October, 23, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2016, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2016, time.October, 17, 9, 0, 0, 0, time.UTC)},
+		// Day 7 is also Sunday
+		{"0 9 * * 7", time.Date(2016, time.October, 23, 9, 0, 0, 0, time.UTC)},
+		// Restricting both days allows either
+		{"0 0 20 * 2", time.Date(2016, time.October, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2016, time.October, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q) failed: %s", test.spec, err)
+			continue
+		}
+		if got := c.next(start); !got.Equal(test.want) {
+			t.Errorf("next(%q) = %s, want %s", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestCronNextIsAfter(t *testing.T) {
+	c, err := parseCron("30 10 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A time that matches is not its own next run
+	start := time.Date(2016, time.October, 16, 10, 30, 0, 0, time.UTC)
+	want := time.Date(2016, time.October, 17, 10, 30, 0, 0, time.UTC)
+	if got := c.next(start); !got.Equal(want) {
+		t.Errorf("next = %s, want %s", got, want)
+	}
+}
@@ -34,6 +34,77 @@ Each action has a pipeline, a series of one or more steps that need to be
 performed to complete the action, configurable in the config file. All steps
 must succeed, in order, for an action to be considered successful.
 
+A stage may be configured with a retry policy, giving the maximum number of
+attempts, a doubling backoff, and which classes of errors ("transport",
+"status", "rpc") should be retried. A sub-agent may also ask for a stage to be
+retried by setting Retry in its response, which is honored while the stage has
+attempts left. Once they run out, the response is used as it is. Every attempt
+is recorded on the job.
+
+A stage may also declare a compensating stage that undoes its work. If a later
+stage fails, the compensating stages of the stages that already completed are
+run in reverse order and their outcomes are recorded on the job.
+
+Services may set a timeout for each call made to them, which for stream
+actions covers the whole transfer, and stages may set a timeout covering all of
+their attempts. A stage that runs out of time fails
+with a timeout error. Synchronous actions also stop when the client's request
+goes away or passes the deadline given in the X-Request-Deadline header.
+
+Instead of a service and method, a stage may list a group of "parallel" stages
+that run concurrently. The pipeline waits for the whole group before moving on
+and reports the errors of all failed stages in the group together. Responses
+from the group are applied in the order the stages are configured, as if they
+had run one after another.
+
+A stage may be made conditional with a "when" Go template, which is evaluated
+against the guest in the request, available as .Guest, before the stage runs.
+The stage is skipped if the template renders as empty or as a false boolean
+such as "false" or "0". For example:
+
+	"when": "{{range .Guest.Nics}}{{if .VLANs}}true{{end}}{{end}}"
+	"when": "{{eq (index .Guest.Metadata \"backup\") \"true\"}}"
+
+Skipped stages are recorded on the job.
+
+Stage args may also be Go templates. Along with .Guest, templates can use the
+hypervisor metadata as .Metadata and the responses of earlier stages in the
+pipeline as .Outputs. Only the responses of stages given a "name" are kept, keyed
+by that name, which must be unique within the action. A named parallel group
+keeps the merged response of its stages. For example, after a stage named
+"define":
+
+	"args": {
+		"owner": "{{index .Guest.Metadata \"owner\"}}",
+		"vnc": "{{(index .Outputs \"define\").Guest.VNC}}"
+	}
+
+Templates are parsed when the config is loaded, so syntax errors are reported at
+startup.
+
+Hooks are stages run around every async action, or only the actions matching
+one of the hook's name patterns, such as "container*". A hook without patterns
+also runs around info and stream actions if it sets "all_types". A hook may have
+"before" stages, run before the action's stages, and "success" and "failure"
+stages, run once the action has finished. Hook stages get their own copy of the
+request, and a failed hook is recorded on the job without changing the action's
+outcome, or logged for info and stream actions, which have no job. Hook stages
+without a timeout are limited to the hook's "timeout" in seconds, defaulting to
+30. Failure hook templates can use the action's error as .Error. For example:
+
+	"hooks": [
+		{
+			"actions": ["create", "delete"],
+			"failure": [
+				{
+					"service": "notify",
+					"method": "Notify.Failure",
+					"args": {"error": "{{.Error}}"}
+				}
+			]
+		}
+	]
+
 There are three action types:
 
 * Info - Information retrieval actions, such as getting a list of guests,
@@ -44,7 +115,134 @@ requesting client when the pipeline is complete.
 asynchronously. One action per guest is performed at a time, while the rest are
 queued. A response containing the job id in the header X-Guest-Job-ID is
 returned after queueing the action, which can be used to check the status at a
-later time.
+later time. A queued action can be cancelled, which removes it from the queue.
+A running action that is cancelled stops straight away, interrupting its current
+stage and any wait to retry it, and the stages it already completed are
+compensated.
+
+The job for an async action also records the progress of each stage as it runs:
+its service and method, start and finish times, outcome, and any message from
+the sub-agent. CurrentStage and StageCount give the position of the stage being
+run. Each stage of a parallel group is recorded separately, with its position in
+the group as Member, which is -1 for stages not in a group.
+
+Queued actions run in order of priority, highest first, and in the order they
+were queued within a priority. An action's priority is set by "priority" in its
+config, defaulting to 0, and may be overridden for a request with the query
+parameter priority. Higher priorities let urgent actions, such as poweroff,
+run ahead of routine work already queued for the guest, but do not interrupt
+the running action.
+
+An action configured with "coalesce" is merged into an identical action, one
+with the same request, that is already queued for the guest and not yet
+running. The existing job's ID is returned in X-Guest-Job-ID and the job notes
+when each request was coalesced into it.
+
+A guest may queue up to "max_queued" async actions, set in the config and
+defaulting to 100, or the value of the guest's "max_queued" metadata. Once the
+queue is full, further actions are rejected with 503 Service Unavailable and a
+Retry-After header rather than waiting for room.
+
+Queued actions are saved along with their requests, so they survive a restart
+of the agent. On startup they are either queued again in their original order,
+or their jobs are failed, depending on "queued_on_restart", which may be
+"resume" (the default) or "fail".
+
+A job that was running when the agent stopped is marked "Interrupted" when the
+agent starts again. An action may configure a "recovery" to run in that case,
+before any other work for the guest. It is either the name of another async
+action, such as one that refreshes the guest's status, or "compensate" to run
+the compensating stages of the stages the job completed. The recovery is queued
+as a new job at the front of the guest's queue, ahead of actions of any
+priority, and its ID is recorded on the interrupted job as Recovery.
+
+Async guest actions may also be scheduled through /schedules, either to run
+once at a set time or repeatedly on a cron schedule. Cron specs have the
+standard five fields, minute, hour, day of month, month, and day of week, in
+the agent's local time, or may be one of @hourly, @daily, @weekly, @monthly,
+or @yearly. For example:
+
+	{"guestID": "...", "action": "restart", "at": "2026-11-01T02:00:00Z"}
+	{"guestID": "...", "action": "poweroff", "cron": "0 20 * * 5"}
+
+Each run queues the action like a request would, and the resulting job records
+the ID of its schedule as Schedule. Schedules can be disabled without deleting
+them, and are removed along with their guest.
+
+A guest may also have snapshot policies, which snapshot all of its disks on a
+cron schedule and keep only the most recent snapshots taken by each policy.
+Policies are set through /guests/{guestID}/snapshot_policies, for example:
+
+	[{"name": "hourly", "keep": 24}, {"name": "nightly", "cron": "0 3 * * *", "keep": 7}]
+
+The hourly, daily, weekly, and monthly policies have default cron specs, and
+may also be set with the guest's "snapshot_policies" metadata, such as
+"hourly:24,daily:7". This replaces the guest's policies like the PUT above, and
+the key is not kept in the metadata. Snapshots are named after their policy and
+when they were taken, such as hourly-1476652800. Each time a policy runs, its
+oldest earlier snapshots beyond the number it keeps are deleted, so the
+snapshot just taken is pruned on a later run. The jobs record the name of
+their policy as SnapshotPolicy.
+
+Job lists from /jobs and /guests/{guestID}/jobs are newest first and may be
+filtered by "status" and "action", each of which may be repeated or comma
+separated, by "guest" on /jobs, and by when jobs were queued with "since" and
+"until" as RFC 3339 times. Up to "limit" jobs are returned, defaulting to the
+whole log. If there are more, the X-Next-Cursor header holds a cursor to pass
+as "cursor" for the next page. Setting "format" to jsonl or csv exports the
+jobs as JSON Lines or CSV instead of a JSON array. For example:
+
+	/jobs?action=create&status=Error&since=2026-10-09T00:00:00Z&format=csv
+
+Requests that start an async action may also include an X-Callback-URL header.
+Once the job finishes, whether it succeeded, failed, was cancelled, or was
+interrupted by a restart, the
+agent POSTs a JSON object with the final Job and the resulting Guest, which is
+null if the guest no longer exists, to that URL. If an X-Callback-Secret header
+was also given, deliveries carry an X-Callback-Signature header of "sha256="
+followed by the hex HMAC-SHA256 of the body, keyed with the secret. Deliveries
+are retried with backoff until the URL responds with a 2xx status or the
+attempts run out, and their status is tracked in the job's Callbacks as
+Pending, Delivered, or Failed. Undelivered callbacks are kept until delivery
+is over, so deliveries still pending when the agent stops carry on once it
+starts again. A request coalesced into an existing job adds its callback to
+that job.
+
+Instead of polling jobs, clients may follow changes through /events, a stream
+of server-sent events, or of JSON messages if the request is upgraded to a
+WebSocket. Events have the types job.queued, job.updated, guest.updated,
+guest.deleted, and guest.metadata, and may be filtered by "guest" and by
+"type", which may be repeated or comma separated and may be a prefix such as
+"job". Each event has an ID. A client that reconnects with the last ID it saw,
+in the Last-Event-ID header or the "lastEventID" parameter, first receives the
+recent events it missed. Only the last 1000 events are kept, and none from
+before the agent restarted, so if any of the missed events are gone the request
+fails with 410 Gone. The client must then fetch the state it needs again and
+reconnect without a last ID. Clients that fall too far behind are disconnected,
+and may reconnect the same way.
+
+How long jobs stay in the job log is set by "job_retention" in the config:
+"max_jobs" across all guests, defaulting to 1000, "max_guest_jobs" for each
+guest, and "max_age" in seconds since a job last changed. Setting a limit to
+0 removes it, even if an earlier config set it. Queued and running jobs are
+always kept. If "archive_dir" is set, pruned jobs are archived there
+as gzipped JSON Lines, rotating to a new file after "archive_max_size" bytes
+and keeping "archive_max_files" files. Archived jobs are read back through
+/jobs/archive and /guests/{guestID}/jobs/archive, with the same filters and
+formats as the job log, but without cursors.
+
+Everything the agent logs for an async job while it is queued or running,
+including informational messages returned by sub-agents, is also captured for
+the job. The lines are served from /jobs/{jobID}/logs, and with "follow" set
+to true they are streamed as JSON Lines until the job finishes. Captured lines
+are saved once the job finishes, so those of a job interrupted by a restart are
+lost, and are removed along with their job when it is pruned from the job log.
+
+Requests that start an async action may include an Idempotency-Key header. If
+the request is repeated with the same key, within a window configured by
+"idempotency_window" in seconds and defaulting to one day, the original
+response and X-Guest-Job-ID are returned instead of queueing the action again.
+Replayed responses carry the header Idempotent-Replayed.
 
 * Stream - Data retrieval, such as downloading a zfs snapshot, called
 synchronously at request time. Rather than a JSON response, data is streamed
@@ -53,6 +251,25 @@ back in chunks.
 Valid actions are defined in:
 http://godoc.org/github.com/mistifyio/mistify-agent/config
 
+Custom guest actions may be configured alongside the built-in ones. A custom
+action must set its "type" to "info", "stream", or "async", and is exposed at
+/guests/{guestID}/actions/{actionName}. For example:
+
+	"actions": {
+		"resetPassword": {
+			"type": "async",
+			"stages": [
+				{"service": "libvirt", "method": "Libvirt.ResetPassword"}
+			]
+		}
+	}
+
+Adding the query parameter dryRun=true to guest creation, guest actions, or
+snapshot creation, deletion, and rollback returns the plan for the action
+instead of running it. The plan lists each stage's service, method, and
+rendered request, and notes stages that would be skipped. No sub-agents are
+called.
+
 HTTP API Endpoints
 
 	/debug/pprof
@@ -74,6 +291,15 @@ HTTP API Endpoints
 		* GET   - Retrieve the hypervisor's metadata
 		* PATCH - Modify the hypervisor's metadata
 
+	/actions
+		* GET - Retrieve a list of configured actions and their stages
+
+	/actions/{actionName}
+		* GET - Retrieve a configured action and its stages
+
+	/services
+		* GET - Retrieve a list of configured services
+
 	/images
 		* GET  - Retrieve a list of disk images
 		* POST - Fetch a disk image
@@ -90,6 +316,32 @@ HTTP API Endpoints
 		* GET    -  Retrieve information about a container image
 		* DELETE - Delete a container image
 
+	/schedules
+		* GET  - Retrieve a list of scheduled actions, optionally for the guest
+		         given by the query parameter guest
+		* POST - Schedule an action
+
+	/schedules/{scheduleID}
+		* GET    - Retrieve a scheduled action
+		* PATCH  - Modify a scheduled action
+		* DELETE - Delete a scheduled action
+
+	/events
+		* GET - Stream job and guest events
+
+	/jobs
+		* GET - Retrieve a list of recent action jobs, optionally filtered
+
+	/jobs/archive
+		* GET - Retrieve a list of archived action jobs
+
+	/jobs/{jobID}
+		* GET    - Retrieve information about a specific action job
+		* DELETE - Cancel a queued or running action job
+
+	/jobs/{jobID}/logs
+		* GET - Retrieve or follow the log lines captured for an action job
+
 	/guests
 		* GET  - Retrieve a list of guests
 		* POST - Create a new guest
@@ -100,13 +352,28 @@ HTTP API Endpoints
 	/guests/{guestID}/jobs
 		* GET - Retrieve a list of recent action jobs for the guest
 
+	/guests/{guestID}/jobs/archive
+		* GET - Retrieve a list of archived action jobs for the guest
+
 	/guests/{guestID}/jobs/{jobID}
-		* GET - Retrieve information about a specific action job
+		* GET    - Retrieve information about a specific action job
+		* DELETE - Cancel a queued or running action job
+
+	/guests/{guestID}/jobs/{jobID}/logs
+		* GET - Retrieve or follow the log lines captured for an action job
 
 	/guests/{guestID}/metadata
 		* GET   - Retrieve a guest's metadata
 		* PATCH - Modify the guest's metadata
 
+	/guests/{guestID}/queue
+		* GET - Retrieve the depth and contents of the guest's async queue
+
+	/guests/{guestID}/snapshot_policies
+		* GET    - Retrieve the guest's snapshot policies
+		* PUT    - Replace the guest's snapshot policies
+		* DELETE - Remove the guest's snapshot policies
+
 	/guests/{guestID}/metrics/cpu
 		* GET - Retrieve guest CPU metrics
 
@@ -118,7 +385,11 @@ HTTP API Endpoints
 
 	/guests/{guestID}/{actionName}
 		Actions: shutdown, reboot, restart, poweroff, start, suspend, delete
-		* GET - Perform the specified action for the guest
+		* POST - Perform the specified action for the guest
+
+	/guests/{guestID}/actions/{actionName}
+		* GET  - Perform a custom info or stream action for the guest
+		* POST - Perform a custom async action for the guest
 
 	/guests/{guestID}/snapshots
 	/guests/{guestID}/disks/{diskID}/snapshots
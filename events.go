@@ -0,0 +1,343 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// Event is a change to a job or guest, as sent to event stream clients
+	Event struct {
+		ID      uint64
+		Type    string
+		GuestID string
+		Time    time.Time
+		Data    interface{}
+	}
+
+	// EventFilter selects the events sent to a subscriber. Empty fields match
+	// any event.
+	EventFilter struct {
+		GuestID string
+		Types   []string // Event types, or their prefixes such as "job"
+	}
+
+	// EventBus sends events to subscribers. Recent events are kept so that
+	// subscribers can resume from the last event they saw.
+	EventBus struct {
+		mutex       sync.Mutex
+		lastID      uint64
+		floor       uint64 // Every event after this ID is in the history
+		history     []*Event
+		subscribers map[chan *Event]*EventFilter
+	}
+
+	// JobEvent is the data of a job event. The full job can be retrieved from
+	// /jobs/{jobID}.
+	JobEvent struct {
+		ID           string
+		Action       string
+		Status       JobStatus
+		Message      string
+		QueuedAt     time.Time
+		StartedAt    time.Time
+		UpdatedAt    time.Time
+		CurrentStage int
+		StageCount   int
+	}
+)
+
+// Event types
+const (
+	JobQueuedEvent     = "job.queued"
+	JobUpdatedEvent    = "job.updated"
+	GuestUpdatedEvent  = "guest.updated"
+	GuestDeletedEvent  = "guest.deleted"
+	GuestMetadataEvent = "guest.metadata"
+)
+
+const (
+	// eventHistorySize is how many recent events are kept for resuming
+	eventHistorySize = 1000
+	// eventBufferSize is how many events may wait for a subscriber before it
+	// is dropped for being too slow
+	eventBufferSize = 100
+	// eventKeepAlive is how often an idle event stream is written to, so that
+	// it is not closed by proxies
+	eventKeepAlive = 30 * time.Second
+)
+
+// ErrEventsExpired is the error for resuming after an event that is no longer
+// kept, such as one from before the agent restarted. The client must resync
+// its state and subscribe again without a last event ID.
+var ErrEventsExpired = errors.New("events after the last event ID are no longer available")
+
+var eventUpgrader = websocket.Upgrader{
+	// Other hosts are allowed to subscribe, as with the rest of the API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// NewEventBus creates a new EventBus. Event IDs start from the current time so
+// that they keep increasing across agent restarts.
+func NewEventBus() *EventBus {
+	start := uint64(time.Now().UnixNano())
+	return &EventBus{
+		lastID:      start,
+		floor:       start,
+		history:     make([]*Event, 0, eventHistorySize),
+		subscribers: make(map[chan *Event]*EventFilter),
+	}
+}
+
+// matches reports whether an event passes the filter
+func (filter *EventFilter) matches(event *Event) bool {
+	if filter.GuestID != "" && event.GuestID != filter.GuestID {
+		return false
+	}
+	if len(filter.Types) == 0 {
+		return true
+	}
+	for _, t := range filter.Types {
+		if event.Type == t || strings.HasPrefix(event.Type, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends an event to all subscribers whose filter it passes. A
+// subscriber that has fallen too far behind is dropped, and can resume from
+// the last event it received.
+func (bus *EventBus) Publish(eventType, guestID string, data interface{}) {
+	if bus == nil {
+		return
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.lastID++
+	event := &Event{
+		ID:      bus.lastID,
+		Type:    eventType,
+		GuestID: guestID,
+		Time:    time.Now(),
+		Data:    data,
+	}
+	if len(bus.history) == eventHistorySize {
+		bus.floor = bus.history[0].ID
+		copy(bus.history, bus.history[1:])
+		bus.history = bus.history[:eventHistorySize-1]
+	}
+	bus.history = append(bus.history, event)
+
+	for ch, filter := range bus.subscribers {
+		if !filter.matches(event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			delete(bus.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe registers a subscriber for events passing a filter. If lastID is
+// not zero, the events after it are returned to be sent first. ErrEventsExpired
+// is returned, without subscribing, if any of those are no longer kept or the
+// ID is unknown. The channel is closed if the subscriber falls too far behind.
+func (bus *EventBus) Subscribe(filter *EventFilter, lastID uint64) ([]*Event, chan *Event, error) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	var missed []*Event
+	if lastID != 0 {
+		if lastID < bus.floor || lastID > bus.lastID {
+			return nil, nil, ErrEventsExpired
+		}
+		for _, event := range bus.history {
+			if event.ID > lastID && filter.matches(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	ch := make(chan *Event, eventBufferSize)
+	bus.subscribers[ch] = filter
+	return missed, ch, nil
+}
+
+// Unsubscribe removes a subscriber
+func (bus *EventBus) Unsubscribe(ch chan *Event) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if _, ok := bus.subscribers[ch]; ok {
+		delete(bus.subscribers, ch)
+		close(ch)
+	}
+}
+
+// newJobEvent summarizes a job for an event. Must be called with the job
+// log's ModifyMutex held.
+func newJobEvent(job *Job) *JobEvent {
+	return &JobEvent{
+		ID:           job.ID,
+		Action:       job.Action,
+		Status:       job.Status,
+		Message:      job.Message,
+		QueuedAt:     job.QueuedAt,
+		StartedAt:    job.StartedAt,
+		UpdatedAt:    job.UpdatedAt,
+		CurrentStage: job.CurrentStage,
+		StageCount:   job.StageCount,
+	}
+}
+
+// streamEvents sends events as server-sent events, or over a WebSocket if the
+// request asks to upgrade. Events may be filtered by guest and type, and a
+// client may resume after the event ID in the Last-Event-ID header or the
+// lastEventID parameter. If the events since then are no longer available, 410
+// Gone is returned and the client must resync.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	params := r.URL.Query()
+
+	if r.Method != "GET" {
+		hr.JSONError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	filter := &EventFilter{
+		GuestID: params.Get("guest"),
+		Types:   splitParams(params["type"]),
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = params.Get("lastEventID")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			hr.JSONError(http.StatusBadRequest, fmt.Errorf("invalid last event ID %q", lastEventID))
+			return
+		}
+	}
+
+	isWebSocket := websocket.IsWebSocketUpgrade(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok && !isWebSocket {
+		hr.JSONError(http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	missed, ch, err := ctx.Events.Subscribe(filter, lastID)
+	if err != nil {
+		hr.JSONError(http.StatusGone, err)
+		return
+	}
+	defer ctx.Events.Unsubscribe(ch)
+
+	if isWebSocket {
+		streamWebSocketEvents(w, r, missed, ch)
+		return
+	}
+
+	hr.Header().Set("Content-Type", "text/event-stream")
+	hr.Header().Set("Cache-Control", "no-cache")
+	hr.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		if err := writeServerSentEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ":\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeServerSentEvent writes an event in the text/event-stream format
+func writeServerSentEvent(w http.ResponseWriter, event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// streamWebSocketEvents sends missed events and then those from a
+// subscription as JSON messages over a WebSocket
+func streamWebSocketEvents(w http.ResponseWriter, r *http.Request, missed []*Event, ch chan *Event) {
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	// Messages from the client are not used, but must be read to notice it
+	// closing the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, event := range missed {
+		if err := conn.WriteJSON(event); err != nil {
+			return
+		}
+	}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventKeepAlive)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
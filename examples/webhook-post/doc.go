@@ -46,5 +46,20 @@ method as a stage of the create action:
 	}
 
 The emoji and username can be overwritten via the `Webhook.Post` stage args.
+
+To post after every action instead, add the stage as a hook:
+
+	{
+	"hooks": [
+		{
+		"success": [
+			{
+			"service": "webhook",
+			"method": "Webhook.Post"
+			}
+		]
+		}
+	]
+	}
 */
 package main
@@ -12,6 +12,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mistifyio/kvite"
 	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/config"
 	"github.com/mistifyio/mistify-agent/rpc"
 	"github.com/pborman/uuid"
 )
@@ -29,17 +30,22 @@ const requestGuestKey = "requestGuest"
 
 // PersistGuest writes guest data to the data store
 func (ctx *Context) PersistGuest(g *client.Guest) error {
-	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	err = ctx.db.Transaction(func(tx *kvite.Tx) error {
 		b, err := tx.Bucket("guests")
 		if err != nil {
 			return err
 		}
-		data, err := json.Marshal(g)
-		if err != nil {
-			return err
-		}
 		return b.Put(g.ID, data)
 	})
+	if err != nil {
+		return err
+	}
+	ctx.Events.Publish(GuestUpdatedEvent, g.ID, json.RawMessage(data))
+	return nil
 }
 
 // DeleteGuest removes a guest from the data store
@@ -56,7 +62,11 @@ func (ctx *Context) DeleteGuest(g *client.Guest) error {
 		return err
 	}
 	ctx.DeleteGuestRunner(g.ID)
-	return nil
+	ctx.Events.Publish(GuestDeletedEvent, g.ID, map[string]string{"id": g.ID})
+	if err := ctx.SetSnapshotPolicies(g.ID, nil); err != nil {
+		return err
+	}
+	return ctx.deleteGuestSchedules(g.ID)
 }
 
 // prefixedActionName creates the appropriate action name for the guest type
@@ -131,36 +141,33 @@ func createGuest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pipeline, _ := ctx.newGuestPipeline(action, g, hr, nil)
+
+	if isDryRun(r) {
+		hr.JSON(http.StatusOK, pipeline.Plan())
+		return
+	}
+
 	if err = ctx.PersistGuest(g); err != nil {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
 	}
 
-	runner := ctx.NewGuestRunner(g.ID, 100, 5)
-
-	response := &rpc.GuestResponse{}
-	request := &rpc.GuestRequest{
-		Guest:  g,
-		Action: action.Name,
-	}
-	pipeline := action.GeneratePipeline(request, response, hr, nil)
-	// PreStageFunc copies the stage args into the request
-	pipeline.PreStageFunc = func(p *Pipeline, s *Stage) error {
-		request.Args = s.Args
-		return nil
-	}
-	// PostStageFunc saves the guest and uses it for the next request
-	pipeline.PostStageFunc = func(p *Pipeline, s *Stage) error {
-		request.Guest = response.Guest
-		return ctx.PersistGuest(response.Guest)
-	}
+	runner := ctx.NewGuestRunner(g.ID, 100, 5, ctx.maxQueued(g))
 
-	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
-	if err != nil {
-		hr.JSONError(http.StatusInternalServerError, err)
+	if err = runner.Process(r.Context(), pipeline); err != nil {
+		// Nothing would ever advance a guest whose create was not queued
+		if err := ctx.DeleteGuest(g); err != nil {
+			log.WithFields(log.Fields{
+				"guest": g.ID,
+				"error": err,
+				"func":  "agent.Context.DeleteGuest",
+			}).Error("Delete Error:", err)
+		}
+		hr.processError(http.StatusInternalServerError, err)
 		return
 	}
+	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
 	hr.JSON(http.StatusAccepted, g)
 }
 
@@ -239,6 +246,31 @@ func setGuestMetadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if value := metadata[MaxQueuedMetadataKey]; value != "" {
+		if _, err := parseMaxQueued(value); err != nil {
+			hr.JSONError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	// Snapshot policies are kept only in the guest's policies, so the key is
+	// applied to those rather than saved with the metadata
+	var policies []*SnapshotPolicy
+	value, setPolicies := metadata[SnapshotPoliciesMetadataKey]
+	if setPolicies && value != "" {
+		if policies, err = parseSnapshotPolicies(value); err != nil {
+			hr.JSONError(http.StatusBadRequest, err)
+			return
+		}
+	}
+	if setPolicies {
+		if err := ctx.SetSnapshotPolicies(g.ID, policies); err != nil {
+			hr.JSONError(http.StatusInternalServerError, err)
+			return
+		}
+		delete(metadata, SnapshotPoliciesMetadataKey)
+		delete(g.Metadata, SnapshotPoliciesMetadataKey)
+	}
+
 	for key, value := range metadata {
 		if value == "" {
 			delete(g.Metadata, key)
@@ -252,9 +284,19 @@ func setGuestMetadata(w http.ResponseWriter, r *http.Request) {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
 	}
+	if runner, err := ctx.GetGuestRunner(g.ID); err == nil {
+		runner.Async.SetMaxQueued(ctx.maxQueued(g))
+	}
+	ctx.Events.Publish(GuestMetadataEvent, g.ID, metadata)
 	hr.JSON(http.StatusOK, g.Metadata)
 }
 
+func getGuestQueue(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	runner := getRequestRunner(r)
+	hr.JSON(http.StatusOK, runner.Async.Info())
+}
+
 // guestRunnerMiddleware gets and places the runner into the request context
 func guestRunnerMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -287,46 +329,131 @@ func generateGuestAction(actionName string) http.HandlerFunc {
 			return
 		}
 
-		response := &rpc.GuestResponse{}
-		request := &rpc.GuestRequest{
-			Guest:  g,
-			Action: action.Name,
-		}
 		doneChan := make(chan error)
-		pipeline := action.GeneratePipeline(request, response, hr, doneChan)
-		// PreStageFunc copies the stage args into the request
-		pipeline.PreStageFunc = func(p *Pipeline, s *Stage) error {
-			request.Args = s.Args
+		pipeline, _ := ctx.newGuestPipeline(action, g, hr, doneChan)
+
+		if isDryRun(r) {
+			hr.JSON(http.StatusOK, pipeline.Plan())
+			return
+		}
+
+		// The job ID is only known once queued, since the action may be
+		// coalesced into an existing job
+		err = runner.Process(r.Context(), pipeline)
+		hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
+		if err != nil {
+			hr.processError(http.StatusInternalServerError, err)
+			return
+		}
+		go ctx.afterGuestAction(g, actionName, doneChan)
+		hr.JSON(http.StatusAccepted, g)
+	}
+}
+
+// newGuestPipeline generates a pipeline for an action on a guest, along with
+// the response its stages share. Each stage's args are copied into the
+// request, and a guest returned by a stage is used for the next request and,
+// for async actions, saved.
+func (ctx *Context) newGuestPipeline(action *Action, g *client.Guest, rw http.ResponseWriter, done chan error) (*Pipeline, *rpc.GuestResponse) {
+	response := &rpc.GuestResponse{}
+	request := &rpc.GuestRequest{
+		Guest:  g,
+		Action: action.Name,
+	}
+	pipeline := action.GeneratePipeline(request, response, rw, done)
+	// PreStageFunc copies the stage args into the request
+	pipeline.PreStageFunc = func(p *Pipeline, s *Stage) error {
+		request.Args = s.Args
+		return nil
+	}
+	// PostStageFunc uses any returned guest for the next request, saving it
+	// if the action is allowed to modify the guest
+	pipeline.PostStageFunc = func(p *Pipeline, s *Stage) error {
+		if response.Guest == nil {
 			return nil
 		}
-		// PostStageFunc saves the guest and uses it for the next request
-		pipeline.PostStageFunc = func(p *Pipeline, s *Stage) error {
-			request.Guest = response.Guest
-			return ctx.PersistGuest(response.Guest)
+		request.Guest = response.Guest
+		if action.Type != config.AsyncAction {
+			return nil
+		}
+		return ctx.PersistGuest(response.Guest)
+	}
+	return pipeline, response
+}
+
+// afterGuestAction does any extra processing once a guest action's pipeline
+// finishes, such as removing a deleted guest
+func (ctx *Context) afterGuestAction(g *client.Guest, actionName string, done chan error) {
+	if <-done != nil {
+		return
+	}
+	if actionName == prefixedActionName(g.Type, "delete") {
+		if err := ctx.DeleteGuest(g); err != nil {
+			log.WithFields(log.Fields{
+				"guest": g.ID,
+				"error": err,
+				"func":  "agent.Context.DeleteGuest",
+			}).Error("Delete Error:", err)
 		}
+	}
+}
 
+// customGuestAction runs a custom action for a guest. Info and stream actions
+// are requested with GET, while async actions are requested with POST.
+func customGuestAction(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	g := getRequestGuest(r)
+	runner := getRequestRunner(r)
+	vars := mux.Vars(r)
+
+	action, err := ctx.GetAction(vars["name"])
+	if err == nil && !action.Custom {
+		err = fmt.Errorf("%s: Not a custom action", action.Name)
+	}
+	if err != nil {
+		hr.JSONError(http.StatusNotFound, err)
+		return
+	}
+
+	method := "GET"
+	if action.Type == config.AsyncAction {
+		method = "POST"
+	}
+	if r.Method != method {
+		hr.Header().Set("Allow", method)
+		hr.JSONError(http.StatusMethodNotAllowed, fmt.Errorf("%s must be requested with %s", action.Name, method))
+		return
+	}
+
+	pipeline, response := ctx.newGuestPipeline(action, g, hr, nil)
+
+	if isDryRun(r) {
+		hr.JSON(http.StatusOK, pipeline.Plan())
+		return
+	}
+
+	if action.Type == config.StreamAction {
 		hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-		err = runner.Process(pipeline)
+		// Streaming handles sending its own error responses
+		_ = runner.Process(r.Context(), pipeline)
+		return
+	}
+
+	err = runner.Process(r.Context(), pipeline)
+	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
+	switch action.Type {
+	case config.InfoAction:
 		if err != nil {
-			hr.JSONError(http.StatusInternalServerError, err)
+			hr.JSONError(getHTTPErrorCode(err), err)
+			return
+		}
+		hr.JSON(http.StatusOK, response)
+	default:
+		if err != nil {
+			hr.processError(http.StatusInternalServerError, err)
 			return
 		}
-		// Extra processing after the pipeline finishes
-		go func() {
-			if <-doneChan != nil {
-				return
-			}
-			if actionName == prefixedActionName(g.Type, "delete") {
-				if err := ctx.DeleteGuest(g); err != nil {
-					log.WithFields(log.Fields{
-						"guest": g.ID,
-						"error": err,
-						"func":  "agent.Context.DeleteGuest",
-					}).Error("Delete Error:", err)
-				}
-				return
-			}
-		}()
 		hr.JSON(http.StatusAccepted, g)
 	}
 }
@@ -1,11 +1,16 @@
 package agent
 
 import (
+	stdcontext "context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"github.com/mistifyio/mistify-agent/client"
 	"github.com/mistifyio/mistify-agent/config"
 )
 
@@ -30,18 +35,46 @@ type (
 
 	// PipelineQueue holds asyncronous action pipelines
 	PipelineQueue struct {
-		GuestID      string
-		Name         string
-		Context      *Context
-		PipelineChan chan *Pipeline
-		QuitChan     chan struct{}
+		GuestID   string
+		Name      string
+		Context   *Context
+		MaxQueued uint
+		Pipelines []*Pipeline // Queued pipelines, next first
+		Running   *Pipeline
+		mutex     sync.Mutex
+		cond      *sync.Cond // Signals changes to the queue
+		quit      bool
+	}
+
+	// QueueInfo describes the state of a guest's async queue
+	QueueInfo struct {
+		Depth     int
+		MaxQueued uint
+		Running   string // ID of the running job, if any
+		Queued    []string
 	}
 )
 
-const requestRunnerKey = "requestRunner"
+const (
+	requestRunnerKey = "requestRunner"
+
+	// MaxQueuedMetadataKey is the guest metadata key that overrides the
+	// agent-wide limit on queued async actions for the guest
+	MaxQueuedMetadataKey = "max_queued"
+
+	// QueueFullRetryAfter is the number of seconds a client is asked to wait
+	// before retrying an action rejected because the queue was full
+	QueueFullRetryAfter = 10
+)
+
+var (
+	// ErrQueueFull is the error for an async action rejected because the
+	// guest's queue is full
+	ErrQueueFull = errors.New("queue is full")
+)
 
 // NewGuestRunner creates a new GuestRunner
-func (context *Context) NewGuestRunner(guestID string, maxInfo uint, maxStream uint) *GuestRunner {
+func (context *Context) NewGuestRunner(guestID string, maxInfo uint, maxStream uint, maxQueued uint) *GuestRunner {
 	// Prevent others from modifying at the same time
 	context.GuestRunnerMutex.Lock()
 	defer context.GuestRunnerMutex.Unlock()
@@ -58,7 +91,7 @@ func (context *Context) NewGuestRunner(guestID string, maxInfo uint, maxStream u
 		GuestID: guestID,
 		Info:    NewSyncThrottle("info", guestID, maxInfo),
 		Stream:  NewSyncThrottle("stream", guestID, maxStream),
-		Async:   NewPipelineQueue("async", guestID, context),
+		Async:   NewPipelineQueue("async", guestID, maxQueued, context),
 	}
 
 	runner.Async.Process()
@@ -99,23 +132,70 @@ func (context *Context) GetAgentRunner() (*GuestRunner, error) {
 	return context.GetGuestRunner("agent")
 }
 
+// maxQueued works out the limit on queued async actions for a guest. A valid
+// limit in the guest's metadata takes precedence over the agent-wide one.
+func (context *Context) maxQueued(g *client.Guest) uint {
+	if g != nil {
+		if value, ok := g.Metadata[MaxQueuedMetadataKey]; ok {
+			if max, err := parseMaxQueued(value); err == nil {
+				return max
+			}
+		}
+	}
+	return context.Config.MaxQueued
+}
+
+// parseMaxQueued parses a limit on queued async actions, which must be
+// positive
+func parseMaxQueued(value string) (uint, error) {
+	max, err := strconv.ParseUint(value, 10, 32)
+	if err == nil && max == 0 {
+		err = errors.New("must be greater than 0")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", MaxQueuedMetadataKey, err)
+	}
+	return uint(max), nil
+}
+
+// QueueDepth returns the number of async actions queued for the guest, not
+// counting the running one
+func (gr *GuestRunner) QueueDepth() int {
+	return gr.Async.Depth()
+}
+
 // Quit shuts down a GuestRunner
 func (gr *GuestRunner) Quit() {
 	LogRunnerInfo(gr.GuestID, "", "", "Quiting")
 	gr.Async.Quit()
 }
 
-// Process directs actions into sync or async handling depending on the type
-func (gr *GuestRunner) Process(pipeline *Pipeline) error {
+// Process directs actions into sync or async handling depending on the type.
+// Sync actions run under the supplied context, while async actions are
+// detached from it since they outlive the request. An async pipeline that is
+// coalesced into an existing job takes on that job's ID. ErrQueueFull is
+// returned if there is no room to queue an async pipeline.
+func (gr *GuestRunner) Process(ctx stdcontext.Context, pipeline *Pipeline) error {
 	var err error
 	switch pipeline.Type {
 	case config.InfoAction:
-		err = gr.Info.Process(pipeline)
+		err = gr.Info.Process(ctx, pipeline)
 	case config.StreamAction:
-		err = gr.Stream.Process(pipeline)
+		err = gr.Stream.Process(ctx, pipeline)
 	case config.AsyncAction:
-		LogRunnerInfo(gr.GuestID, "async", "", "Queued")
-		gr.Async.Enqueue(pipeline)
+		if priority, ok := requestPriority(ctx); ok {
+			pipeline.Priority = priority
+		}
+		if callback, ok := requestCallback(ctx); ok {
+			pipeline.Callbacks = append(pipeline.Callbacks, callback)
+		}
+		var id string
+		if id, err = gr.Async.Enqueue(pipeline); err != nil {
+			LogRunnerInfo(gr.GuestID, "async", pipeline.ID, "Rejected: "+err.Error())
+			break
+		}
+		LogRunnerInfo(gr.GuestID, "async", id, "Queued")
+		pipeline.ID = id
 	}
 	return err
 }
@@ -135,11 +215,11 @@ func NewSyncThrottle(name string, guestID string, maxConcurrency uint) *SyncThro
 }
 
 // Process runs an action
-func (st *SyncThrottle) Process(pipeline *Pipeline) error {
+func (st *SyncThrottle) Process(ctx stdcontext.Context, pipeline *Pipeline) error {
 	st.Reserve()
 	defer st.Release()
 
-	return pipeline.Run()
+	return pipeline.Run(ctx)
 }
 
 // Reserve blocks until an action is allowed to run based on throttling
@@ -155,60 +235,363 @@ func (st *SyncThrottle) Release() {
 }
 
 // NewPipelineQueue creates a new PipelineQueue
-func NewPipelineQueue(name string, guestID string, context *Context) *PipelineQueue {
-	max := 100
+func NewPipelineQueue(name string, guestID string, maxQueued uint, context *Context) *PipelineQueue {
 	pq := &PipelineQueue{
-		Name:         name,
-		GuestID:      guestID,
-		PipelineChan: make(chan *Pipeline, max),
-		QuitChan:     make(chan struct{}),
-		Context:      context,
+		Name:      name,
+		GuestID:   guestID,
+		MaxQueued: maxQueued,
+		Context:   context,
 	}
+	pq.cond = sync.NewCond(&pq.mutex)
 	return pq
 }
 
-// Enqueue queues an async action
-func (pq *PipelineQueue) Enqueue(pipeline *Pipeline) {
-	if err := pq.Context.JobLog.AddJob(pipeline.ID, pq.GuestID, pipeline.Action); err != nil {
+// Enqueue queues an async action and returns the ID of its job. The pipeline is
+// queued behind those with the same or a higher priority. If the pipeline
+// coalesces and an identical pipeline is already queued, it is not queued and
+// the ID of the existing job is returned. ErrQueueFull is returned, without
+// creating a job, if the queue is already at its limit.
+func (pq *PipelineQueue) Enqueue(pipeline *Pipeline) (string, error) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if existing := pq.findIdentical(pipeline); existing != nil {
+		if err := pq.Context.JobLog.AddCoalesced(existing.ID); err != nil {
+			LogRunnerError(pq.GuestID, pq.Name, existing.ID, err.Error())
+		}
+		LogRunnerInfo(pq.GuestID, pq.Name, existing.ID, "Coalesced")
+		// The existing job notifies the merged request's callbacks too
+		pq.addCallbacks(existing.ID, pipeline.Callbacks)
+		if pipeline.DoneChan != nil {
+			go func() {
+				pipeline.DoneChan <- ErrCoalesced
+			}()
+		}
+		return existing.ID, nil
+	}
+
+	if uint(len(pq.Pipelines)) >= pq.MaxQueued {
+		return "", ErrQueueFull
+	}
+	if err := pq.Context.JobLog.AddJob(pipeline.ID, pq.GuestID, pipeline.Action, pipeline.Priority); err != nil {
 		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
 	}
-	pq.PipelineChan <- pipeline
-	return
+	pq.addCallbacks(pipeline.ID, pipeline.Callbacks)
+	if err := pq.Context.saveQueued(pq.GuestID, pipeline); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	pq.insert(pipeline)
+	return pipeline.ID, nil
+}
+
+// addCallbacks records callbacks on a job and keeps them until they have been
+// delivered. Must be called with the mutex held, so that callbacks are kept in
+// the same order as they are recorded.
+func (pq *PipelineQueue) addCallbacks(jobID string, callbacks []*Callback) {
+	if len(callbacks) == 0 {
+		return
+	}
+	if err := pq.Context.JobLog.AddCallbacks(jobID, callbacks); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, jobID, err.Error())
+	}
+	if err := pq.Context.saveCallbacks(jobID, callbacks); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, jobID, err.Error())
+	}
+}
+
+// enqueueRecovery queues a pipeline recovering an interrupted job as a new job.
+// Recoveries are queued ahead of all other pipelines, whatever their priority,
+// and even if the queue is over its limit.
+func (pq *PipelineQueue) enqueueRecovery(pipeline *Pipeline, interruptedID string) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if err := pq.Context.JobLog.AddJob(pipeline.ID, pq.GuestID, pipeline.Action, pipeline.Priority); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	pipeline.recovers = interruptedID
+	if err := pq.Context.saveQueued(pq.GuestID, pipeline); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	pq.insert(pipeline)
+}
+
+// restore queues a pipeline that was saved before a restart. Its job already
+// exists, and it is queued even if the queue is over its limit so no work is
+// lost.
+func (pq *PipelineQueue) restore(pipeline *Pipeline) {
+	pq.Context.captureJobOutput(pipeline.ID)
+
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pipeline.Coalesce {
+		if key, err := pipeline.identity(); err == nil {
+			pipeline.coalesceKey = key
+		}
+	}
+	pq.insert(pipeline)
+}
+
+// contains reports whether a job's pipeline is queued or running
+func (pq *PipelineQueue) contains(jobID string) bool {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.Running != nil && pq.Running.ID == jobID {
+		return true
+	}
+	for _, pipeline := range pq.Pipelines {
+		if pipeline.ID == jobID {
+			return true
+		}
+	}
+	return false
+}
+
+// insert adds a pipeline to the queue behind those with the same or a higher
+// priority. Recoveries go behind only other recoveries, and other pipelines
+// never pass them. Must be called with the mutex held.
+func (pq *PipelineQueue) insert(pipeline *Pipeline) {
+	i := len(pq.Pipelines)
+	for i > 0 && pq.Pipelines[i-1].recovers == "" && (pipeline.recovers != "" || pq.Pipelines[i-1].Priority < pipeline.Priority) {
+		i--
+	}
+	pq.Pipelines = append(pq.Pipelines, nil)
+	copy(pq.Pipelines[i+1:], pq.Pipelines[i:])
+	pq.Pipelines[i] = pipeline
+	pq.cond.Broadcast()
+}
+
+// Depth returns the number of queued pipelines, not counting the running one
+func (pq *PipelineQueue) Depth() int {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	return len(pq.Pipelines)
+}
+
+// SetMaxQueued changes the limit on queued pipelines. Pipelines already queued
+// beyond a lowered limit are left in the queue.
+func (pq *PipelineQueue) SetMaxQueued(maxQueued uint) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	pq.MaxQueued = maxQueued
+}
+
+// Info describes the state of the queue
+func (pq *PipelineQueue) Info() *QueueInfo {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	info := &QueueInfo{
+		Depth:     len(pq.Pipelines),
+		MaxQueued: pq.MaxQueued,
+		Queued:    make([]string, len(pq.Pipelines)),
+	}
+	if pq.Running != nil {
+		info.Running = pq.Running.ID
+	}
+	for i, pipeline := range pq.Pipelines {
+		info.Queued[i] = pipeline.ID
+	}
+	return info
+}
+
+// findIdentical looks for a queued pipeline identical to one that coalesces.
+// Must be called with the mutex held.
+func (pq *PipelineQueue) findIdentical(pipeline *Pipeline) *Pipeline {
+	if !pipeline.Coalesce {
+		return nil
+	}
+	key, err := pipeline.identity()
+	if err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+		return nil
+	}
+	pipeline.coalesceKey = key
+	for _, queued := range pq.Pipelines {
+		if queued.coalesceKey == key {
+			return queued
+		}
+	}
+	return nil
+}
+
+// next waits for and removes the next queued pipeline, marking it as running.
+// It returns nil once the queue has been told to quit.
+func (pq *PipelineQueue) next() *Pipeline {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	pq.Running = nil
+	for len(pq.Pipelines) == 0 && !pq.quit {
+		pq.cond.Wait()
+	}
+	if pq.quit {
+		return nil
+	}
+	pipeline := pq.Pipelines[0]
+	pq.Pipelines = pq.Pipelines[1:]
+	pq.Running = pipeline
+	pq.cond.Broadcast()
+	return pipeline
 }
 
 // Process monitors the queue and kicks off async actions
 func (pq *PipelineQueue) Process() {
 	go func() {
 		for {
-			select {
-			case <-pq.QuitChan:
+			pipeline := pq.next()
+			if pipeline == nil {
 				LogRunnerInfo(pq.GuestID, pq.Name, "", "Quitting")
 				return
-			case pipeline := <-pq.PipelineChan:
-				if err := pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, Running, ""); err != nil {
-					LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
-				}
-				if err := pipeline.Run(); err != nil {
-					if err = pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, Errored, err.Error()); err != nil {
-						LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
-					}
-					LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
-				} else {
-					if err = pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, Complete, ""); err != nil {
-						LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
-					}
-					LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, "Success")
-				}
 			}
+			pq.run(pipeline)
 		}
 	}()
 }
 
+// run runs a pipeline and records the outcome in the job log
+func (pq *PipelineQueue) run(pipeline *Pipeline) {
+	pipeline.AttemptFunc = pq.recordAttempt
+	pipeline.RollbackFunc = pq.recordRollback
+	pipeline.SkipFunc = pq.recordSkipped
+	pipeline.ProgressFunc = pq.recordProgress
+	pipeline.HookFunc = pq.recordHook
+	LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, "Running")
+	if err := pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, Running, ""); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	// The saved pipeline is only removed once the job is marked as running, so
+	// that after a restart the job is either restored or recovered
+	if err := pq.Context.deleteQueued(pipeline.ID); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+
+	err := pipeline.Run(stdcontext.Background())
+	status, message := Complete, ""
+	switch err {
+	case nil:
+		LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, "Success")
+	case ErrCancelled:
+		status, message = Cancelled, err.Error()
+		LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, "Cancelled")
+	default:
+		status, message = Errored, err.Error()
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	if err := pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, status, message); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	pq.Context.deliverCallbacks(pq.GuestID, pipeline.ID)
+}
+
+// Cancel cancels a job. A queued job is removed from the queue, while a
+// running job has its current stage interrupted. ErrNotFound is returned if the
+// job is neither queued nor running, including a running job that finishes
+// before it can be cancelled.
+func (pq *PipelineQueue) Cancel(jobID string) error {
+	pq.mutex.Lock()
+	if pq.Running != nil && pq.Running.ID == jobID {
+		cancelled := pq.Running.Cancel()
+		pq.mutex.Unlock()
+		if !cancelled {
+			return ErrNotFound
+		}
+		LogRunnerInfo(pq.GuestID, pq.Name, jobID, "Cancelling")
+		return nil
+	}
+
+	var pipeline *Pipeline
+	for i, queued := range pq.Pipelines {
+		if queued.ID == jobID {
+			pipeline = queued
+			pq.Pipelines = append(pq.Pipelines[:i], pq.Pipelines[i+1:]...)
+			pq.cond.Broadcast()
+			break
+		}
+	}
+	pq.mutex.Unlock()
+
+	if pipeline == nil {
+		return ErrNotFound
+	}
+	LogRunnerInfo(pq.GuestID, pq.Name, jobID, "Removed from queue")
+	if err := pq.Context.deleteQueued(jobID); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, jobID, err.Error())
+	}
+	if pipeline.DoneChan != nil {
+		go func() {
+			pipeline.DoneChan <- ErrCancelled
+		}()
+	}
+	if err := pq.Context.JobLog.UpdateJob(pipeline.ID, pipeline.Action, Cancelled, ErrCancelled.Error()); err != nil {
+		return err
+	}
+	pq.Context.deliverCallbacks(pq.GuestID, pipeline.ID)
+	return nil
+}
+
+// recordAttempt adds a stage attempt to the pipeline's job
+func (pq *PipelineQueue) recordAttempt(pipeline *Pipeline, stage *Stage, attempt *StageAttempt) {
+	if err := pq.Context.JobLog.AddAttempt(pipeline.ID, attempt); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	if attempt.Message != "" {
+		LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("%s: %s", attempt.Method, attempt.Message))
+	}
+	if attempt.Error != "" {
+		LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("%s attempt %d: %s", attempt.Method, attempt.Attempt, attempt.Error))
+	}
+}
+
+// recordRollback adds a stage compensation to the pipeline's job
+func (pq *PipelineQueue) recordRollback(pipeline *Pipeline, rollback *StageRollback) {
+	if err := pq.Context.JobLog.AddRollback(pipeline.ID, rollback); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	if rollback.Error != "" {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("rollback of %s with %s failed: %s", rollback.Stage, rollback.Method, rollback.Error))
+		return
+	}
+	LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("rolled back %s with %s", rollback.Stage, rollback.Method))
+}
+
+// recordSkipped adds a skipped stage to the pipeline's job
+func (pq *PipelineQueue) recordSkipped(pipeline *Pipeline, stage *Stage) {
+	if err := pq.Context.JobLog.AddSkipped(pipeline.ID, stage.name()); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	LogRunnerInfo(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("skipped %s", stage.name()))
+}
+
+// recordProgress updates the progress of a stage on the pipeline's job
+func (pq *PipelineQueue) recordProgress(pipeline *Pipeline, progress *StageProgress) {
+	if err := pq.Context.JobLog.UpdateStage(pipeline.ID, len(pipeline.Stages), progress); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+}
+
+// recordHook adds a hook stage run to the pipeline's job. A failed hook is
+// logged but does not affect the job's outcome.
+func (pq *PipelineQueue) recordHook(pipeline *Pipeline, run *HookRun) {
+	if err := pq.Context.JobLog.AddHookRun(pipeline.ID, run); err != nil {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, err.Error())
+	}
+	if run.Error != "" {
+		LogRunnerError(pq.GuestID, pq.Name, pipeline.ID, fmt.Sprintf("%s hook %s failed: %s", run.Hook, run.Method, run.Error))
+	}
+}
+
 // Quit signals the pipeline queue to stop processing after the current action
 func (pq *PipelineQueue) Quit() {
-	go func() {
-		pq.QuitChan <- struct{}{}
-	}()
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	pq.quit = true
+	pq.cond.Broadcast()
 }
 
 // LogRunnerInfo writes informational logs
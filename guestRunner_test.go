@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/config"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+// queuedIDs lists the IDs of a queue's pipelines, next first
+func queuedIDs(pq *PipelineQueue) string {
+	ids := ""
+	for _, pipeline := range pq.Pipelines {
+		ids += pipeline.ID
+	}
+	return ids
+}
+
+func TestPipelineQueueInsert(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int // Of pipelines a, b, c, ... in the order they are queued
+		want       string
+	}{
+		{"same priority", []int{0, 0, 0}, "abc"},
+		{"higher first", []int{0, 1, 2}, "cba"},
+		{"lower last", []int{2, 1, 0}, "abc"},
+		{"same priority keeps order", []int{1, 0, 1, 0, 1}, "acebd"},
+		{"negative", []int{0, -1, 0}, "acb"},
+	}
+	for _, test := range tests {
+		pq := NewPipelineQueue("async", "guest", 10, nil)
+		for i, priority := range test.priorities {
+			pq.insert(&Pipeline{ID: string(rune('a' + i)), Priority: priority})
+		}
+		if got := queuedIDs(pq); got != test.want {
+			t.Errorf("%s: got queue %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// newTestContext creates a context with an empty job log, backed by a database
+// in a temporary directory that is removed by the returned func
+func newTestContext(t *testing.T) (*Context, func()) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.NewConfig()
+	cfg.DBPath = filepath.Join(dir, "agent.db")
+	ctx, err := NewContext(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	ctx.JobLog = &JobLog{
+		Context:    ctx,
+		Index:      make(map[string]int),
+		GuestIndex: make(map[string][]int),
+	}
+	return ctx, func() { os.RemoveAll(dir) }
+}
+
+// testGuestPipeline creates an async pipeline for a guest action
+func testGuestPipeline(id, action string, coalesce bool, g *client.Guest) *Pipeline {
+	return &Pipeline{
+		ID:       id,
+		Action:   action,
+		Type:     config.AsyncAction,
+		Coalesce: coalesce,
+		request:  &rpc.GuestRequest{Guest: g},
+	}
+}
+
+func TestPipelineQueueCoalesce(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	pq := NewPipelineQueue("async", "guest", 10, ctx)
+
+	g := &client.Guest{ID: "guest"}
+	other := &client.Guest{ID: "guest", Metadata: map[string]string{"key": "value"}}
+	tests := []struct {
+		pipeline *Pipeline
+		wantID   string
+	}{
+		{testGuestPipeline("a", "reboot", true, g), "a"},
+		// Identical to a
+		{testGuestPipeline("b", "reboot", true, g), "a"},
+		// A different request
+		{testGuestPipeline("c", "reboot", true, other), "c"},
+		// A different action
+		{testGuestPipeline("d", "stop", true, g), "d"},
+		// Identical to a, but not coalescing
+		{testGuestPipeline("e", "reboot", false, g), "e"},
+	}
+	for _, test := range tests {
+		id, err := pq.Enqueue(test.pipeline)
+		if err != nil {
+			t.Fatalf("%s: %s", test.pipeline.ID, err)
+		}
+		if id != test.wantID {
+			t.Errorf("%s: queued as job %s, want %s", test.pipeline.ID, id, test.wantID)
+		}
+	}
+	if got := queuedIDs(pq); got != "acde" {
+		t.Errorf("got queue %s, want acde", got)
+	}
+}
+
+func TestPipelineQueueCoalesceSignalsDone(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	pq := NewPipelineQueue("async", "guest", 10, ctx)
+
+	g := &client.Guest{ID: "guest"}
+	if _, err := pq.Enqueue(testGuestPipeline("a", "reboot", true, g)); err != nil {
+		t.Fatal(err)
+	}
+	merged := testGuestPipeline("b", "reboot", true, g)
+	merged.DoneChan = make(chan error)
+	if _, err := pq.Enqueue(merged); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-merged.DoneChan; err != ErrCoalesced {
+		t.Errorf("got done error %v, want %v", err, ErrCoalesced)
+	}
+}
+
+func TestPipelineQueueFull(t *testing.T) {
+	ctx, cleanup := newTestContext(t)
+	defer cleanup()
+	pq := NewPipelineQueue("async", "guest", 1, ctx)
+
+	g := &client.Guest{ID: "guest"}
+	if _, err := pq.Enqueue(testGuestPipeline("a", "reboot", true, g)); err != nil {
+		t.Fatal(err)
+	}
+	// Coalescing into a queued pipeline does not need room in the queue
+	if _, err := pq.Enqueue(testGuestPipeline("b", "reboot", true, g)); err != nil {
+		t.Errorf("coalescing into a full queue failed: %s", err)
+	}
+	if _, err := pq.Enqueue(testGuestPipeline("c", "stop", true, g)); err != ErrQueueFull {
+		t.Errorf("got error %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestPipelineQueueInsertRecovery(t *testing.T) {
+	pq := NewPipelineQueue("async", "guest", 10, nil)
+	pq.insert(&Pipeline{ID: "a", Priority: 0})
+	pq.insert(&Pipeline{ID: "b", Priority: 5})
+	// Recoveries go ahead of everything but earlier recoveries
+	pq.insert(&Pipeline{ID: "c", Priority: -1, recovers: "x"})
+	pq.insert(&Pipeline{ID: "d", Priority: 0, recovers: "y"})
+	// Nothing passes a recovery, whatever its priority
+	pq.insert(&Pipeline{ID: "e", Priority: 10})
+	if got := queuedIDs(pq); got != "cdeba" {
+		t.Errorf("got queue %s, want cdeba", got)
+	}
+}
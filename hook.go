@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/mistify-agent/config"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+type (
+	// Hook holds the stages run around every action it matches
+	Hook struct {
+		Config  config.Hook
+		Before  []*Stage
+		Success []*Stage
+		Failure []*Stage
+	}
+
+	// HookRun records the outcome of a hook stage
+	HookRun struct {
+		Hook       string // before, success, or failure
+		Service    string
+		Method     string
+		StartedAt  time.Time
+		FinishedAt time.Time
+		Error      string
+	}
+)
+
+const (
+	// HookBefore is the kind of hook run before an action's stages
+	HookBefore = "before"
+	// HookSuccess is the kind of hook run after an action succeeds
+	HookSuccess = "success"
+	// HookFailure is the kind of hook run after an action fails
+	HookFailure = "failure"
+
+	// defaultHookTimeout limits hook stages when neither they nor their hook
+	// set a timeout, so that a hung hook cannot hold up the guest's queue
+	defaultHookTimeout = 30 * time.Second
+)
+
+// newHook creates a hook from its configuration. Hook stages are always plain
+// JSON calls, whatever the type of the action they run around.
+func (ctx *Context) newHook(cfgHook config.Hook) (*Hook, error) {
+	hook := &Hook{
+		Config: cfgHook,
+	}
+	timeout := time.Duration(cfgHook.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	var err error
+	if hook.Before, err = ctx.newHookStages(cfgHook.Before, timeout); err != nil {
+		return nil, err
+	}
+	if hook.Success, err = ctx.newHookStages(cfgHook.Success, timeout); err != nil {
+		return nil, err
+	}
+	if hook.Failure, err = ctx.newHookStages(cfgHook.Failure, timeout); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// newHookStages creates a hook's stages, limiting those without a timeout of
+// their own to the hook's
+func (ctx *Context) newHookStages(cfgStages []config.Stage, timeout time.Duration) ([]*Stage, error) {
+	stages := make([]*Stage, len(cfgStages))
+	for i, cfgStage := range cfgStages {
+		stage, err := ctx.newStage(config.InfoAction, cfgStage)
+		if err != nil {
+			return nil, err
+		}
+		if stage.Timeout == 0 {
+			stage.Timeout = timeout
+		}
+		stages[i] = stage
+	}
+	return stages, nil
+}
+
+// addHooks adds instances of the stages of every hook matching the pipeline's
+// action
+func (pipeline *Pipeline) addHooks(request interface{}, response interface{}) {
+	if pipeline.ctx == nil {
+		return
+	}
+	for _, hook := range pipeline.ctx.Hooks {
+		if !hook.Config.Matches(pipeline.Action, pipeline.Type) {
+			continue
+		}
+		pipeline.before = append(pipeline.before, hookInstances(pipeline, hook.Before, request, response)...)
+		pipeline.success = append(pipeline.success, hookInstances(pipeline, hook.Success, request, response)...)
+		pipeline.failure = append(pipeline.failure, hookInstances(pipeline, hook.Failure, request, response)...)
+	}
+}
+
+func hookInstances(pipeline *Pipeline, stages []*Stage, request interface{}, response interface{}) []*Stage {
+	instances := make([]*Stage, len(stages))
+	for i, stage := range stages {
+		instances[i] = stage.instance(pipeline, request, response, nil)
+		instances[i].Type = config.InfoAction
+	}
+	return instances
+}
+
+// runHooks runs hook stages in order, stopping at the first failure. Hooks
+// get their own copy of the request and response so they cannot affect the
+// action, and their errors are only recorded, or logged for pipelines that do
+// not record hooks, such as those of sync actions.
+func (pipeline *Pipeline) runHooks(ctx context.Context, kind string, stages []*Stage) {
+	for _, stage := range stages {
+		run, err := stage.shouldRun()
+		if err == nil && !run {
+			continue
+		}
+		record := &HookRun{
+			Hook:      kind,
+			Method:    stage.Method,
+			StartedAt: time.Now(),
+		}
+		if stage.Service != nil {
+			record.Service = stage.Service.Name
+		}
+		if err == nil {
+			err = stage.renderArgs()
+		}
+		if err == nil {
+			stage.Request = withArgs(copyValue(stage.Request), stage.Args)
+			stage.Response = newValue(stage.Response)
+			err = stage.Run(ctx)
+		}
+		record.FinishedAt = time.Now()
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if pipeline.HookFunc != nil {
+			pipeline.HookFunc(pipeline, record)
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"action":   pipeline.Action,
+				"pipeline": pipeline.ID,
+			}).Error(fmt.Sprintf("%s hook %s failed: %s", kind, record.Method, record.Error))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// withArgs sets the args of a request that carries them
+func withArgs(request interface{}, args map[string]string) interface{} {
+	switch r := request.(type) {
+	case *rpc.GuestRequest:
+		r.Args = args
+	case *rpc.GuestMetricsRequest:
+		r.Args = args
+	}
+	return request
+}
@@ -3,6 +3,7 @@ package agent
 // the HTTP interface
 
 import (
+	stdcontext "context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"os"
 	"runtime"
 	runtime_pprof "runtime/pprof"
+	"strconv"
+	"time"
 
 	"github.com/bakins/logrus-middleware"
 	"github.com/bakins/net-http-recover"
@@ -40,7 +43,13 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("http error code: %d, message: %s", e.Code, e.Message)
 }
 
-const ctxKey string = "agentContext"
+const (
+	ctxKey string = "agentContext"
+
+	// DeadlineHeader is the request header a client may use to set an RFC3339
+	// deadline for synchronous actions
+	DeadlineHeader = "X-Request-Deadline"
+)
 
 var (
 	// ErrNotFound is the error for a resouce not found
@@ -65,6 +74,13 @@ func Run(ctx *Context, address string) error {
 
 	AttachProfiler(r)
 
+	contextMiddleware := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			context.Set(r, ctxKey, ctx)
+			h.ServeHTTP(w, r)
+		})
+	}
+
 	logrusMiddleware := logrusmiddleware.Middleware{
 		Name: "agent",
 	}
@@ -76,12 +92,20 @@ func Run(ctx *Context, address string) error {
 		func(h http.Handler) http.Handler {
 			return recovery.Handler(os.Stderr, h, true)
 		},
+		deadlineMiddleware,
+		priorityMiddleware,
+		callbackMiddleware,
+		contextMiddleware,
+		idempotencyMiddleware,
+	)
+
+	// Streams are long lived and must be flushed as they go, so they skip the
+	// request logging and compression
+	streamMiddleware := alice.New(
 		func(h http.Handler) http.Handler {
-			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				context.Set(r, ctxKey, ctx)
-				h.ServeHTTP(w, r)
-			})
+			return recovery.Handler(os.Stderr, h, true)
 		},
+		contextMiddleware,
 	)
 
 	guestMiddleware := alice.New(
@@ -93,6 +117,10 @@ func Run(ctx *Context, address string) error {
 	r.HandleFunc("/metadata", getMetadata).Methods("GET")
 	r.HandleFunc("/metadata", setMetadata).Methods("PATCH")
 
+	r.HandleFunc("/actions", listActions).Methods("GET")
+	r.HandleFunc("/actions/{name}", getActionInfo).Methods("GET")
+	r.HandleFunc("/services", listServices).Methods("GET")
+
 	r.HandleFunc("/images", listImages).Queries("type", "{type:[a-zA-Z]+}").Methods("GET")
 	r.HandleFunc("/images", listImages).Methods("GET")
 	r.HandleFunc("/images", fetchImage).Methods("POST")
@@ -101,9 +129,16 @@ func Run(ctx *Context, address string) error {
 	r.HandleFunc("/images/{id}", deleteImage).Queries("type", "{type:[a-zA-Z]+}").Methods("DELETE")
 	r.HandleFunc("/images/{id}", deleteImage).Methods("DELETE")
 
-	r.HandleFunc("/jobs", getLatestJobs).Methods("GET").Queries("limit", "{limit:[0-9]+}").Methods("GET")
+	r.HandleFunc("/schedules", listSchedules).Methods("GET")
+	r.HandleFunc("/schedules", createSchedule).Methods("POST")
+	r.HandleFunc("/schedules/{scheduleID}", getSchedule).Methods("GET")
+	r.HandleFunc("/schedules/{scheduleID}", updateSchedule).Methods("PATCH")
+	r.HandleFunc("/schedules/{scheduleID}", deleteSchedule).Methods("DELETE")
+
 	r.HandleFunc("/jobs", getLatestJobs).Methods("GET")
+	r.HandleFunc("/jobs/archive", getArchivedJobs).Methods("GET")
 	r.HandleFunc("/jobs/{jobID}", getJobStatus).Methods("GET")
+	r.HandleFunc("/jobs/{jobID}", cancelJob).Methods("DELETE")
 
 	// Guest Routes
 	r.HandleFunc("/guests", listGuests).Methods("GET")
@@ -115,9 +150,10 @@ func Run(ctx *Context, address string) error {
 
 	// Specific guest, but don't need the guest middlewares, so register
 	// separately from the subrouter
-	r.HandleFunc("/guests/{id}/jobs", getLatestGuestJobs).Queries("limit", "{limit:[0-9]+}").Methods("GET")
 	r.HandleFunc("/guests/{id}/jobs", getLatestGuestJobs).Methods("GET")
+	r.HandleFunc("/guests/{id}/jobs/archive", getArchivedJobs).Methods("GET")
 	r.HandleFunc("/guests/{id}/jobs/{jobID}", getJobStatus).Methods("GET")
+	r.HandleFunc("/guests/{id}/jobs/{jobID}", cancelJob).Methods("DELETE")
 
 	// Guest subrouter
 	// Since middleware needs to be applied, a basic subrouter can't be used.
@@ -129,6 +165,12 @@ func Run(ctx *Context, address string) error {
 	gr.HandleFunc("/metadata", getGuestMetadata).Methods("GET")
 	gr.HandleFunc("/metadata", setGuestMetadata).Methods("PATCH")
 
+	gr.HandleFunc("/queue", getGuestQueue).Methods("GET")
+
+	gr.HandleFunc("/snapshot_policies", getSnapshotPolicies).Methods("GET")
+	gr.HandleFunc("/snapshot_policies", setSnapshotPolicies).Methods("PUT")
+	gr.HandleFunc("/snapshot_policies", deleteSnapshotPolicies).Methods("DELETE")
+
 	gr.HandleFunc("/metrics/cpu", getCPUMetrics).Methods("GET")
 	gr.HandleFunc("/metrics/disk", getDiskMetrics).Methods("GET")
 	gr.HandleFunc("/metrics/nic", getNicMetrics).Methods("GET")
@@ -137,6 +179,8 @@ func Run(ctx *Context, address string) error {
 		gr.HandleFunc(fmt.Sprintf("/%s", action), generateGuestAction(action)).Methods("POST")
 	}
 
+	gr.HandleFunc("/actions/{name}", customGuestAction).Methods("GET", "POST")
+
 	for _, prefix := range []string{"", "/disks/{disk}"} {
 		gr.HandleFunc(fmt.Sprintf("%s/snapshots", prefix), listSnapshots).Methods("GET")
 		gr.HandleFunc(fmt.Sprintf("%s/snapshots", prefix), createSnapshot).Methods("POST")
@@ -146,18 +190,87 @@ func Run(ctx *Context, address string) error {
 		gr.HandleFunc(fmt.Sprintf("%s/snapshots/{name}/download", prefix), downloadSnapshot).Methods("GET")
 	}
 
+	// Streaming routes check their own methods, since a method mismatch would
+	// otherwise send the request to the main router
+	streams := mux.NewRouter()
+	streams.HandleFunc("/events", streamEvents)
+	streams.HandleFunc("/jobs/{jobID}/logs", getJobLogs)
+	streams.HandleFunc("/guests/{id}/jobs/{jobID}/logs", getJobLogs)
+
+	streamHandler := streamMiddleware.Then(streams)
+	commonHandler := commonMiddleware.Then(r)
+	root := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var match mux.RouteMatch
+		if streams.Match(req, &match) {
+			streamHandler.ServeHTTP(w, req)
+			return
+		}
+		commonHandler.ServeHTTP(w, req)
+	})
+
 	s := &http.Server{
 		Addr:           address,
-		Handler:        commonMiddleware.Then(r),
+		Handler:        root,
 		MaxHeaderBytes: 1 << 20,
 	}
 	return s.ListenAndServe()
 }
 
-func getMetadata(w http.ResponseWriter, r *http.Request) {
-	hr := HTTPResponse{w}
-	ctx := getContext(r)
+// deadlineMiddleware applies a client supplied deadline to the request context.
+// It must run before anything is stored for the request with gorilla/context,
+// since the request is replaced.
+func deadlineMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(DeadlineHeader)
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		deadline, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			hr := HTTPResponse{w}
+			hr.JSONError(http.StatusBadRequest, fmt.Errorf("invalid %s: %s", DeadlineHeader, err))
+			return
+		}
+		rctx, cancel := stdcontext.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(rctx))
+	})
+}
 
+// priorityKey is the request context key for a requested job priority
+type priorityKey struct{}
+
+// priorityMiddleware applies a client supplied priority for async actions,
+// given by the query parameter priority, to the request context. It must run
+// before anything is stored for the request with gorilla/context, since the
+// request is replaced.
+func priorityMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("priority")
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			hr := HTTPResponse{w}
+			hr.JSONError(http.StatusBadRequest, fmt.Errorf("invalid priority: %s", err))
+			return
+		}
+		rctx := stdcontext.WithValue(r.Context(), priorityKey{}, priority)
+		h.ServeHTTP(w, r.WithContext(rctx))
+	})
+}
+
+// requestPriority retrieves a client supplied priority from a request context
+func requestPriority(rctx stdcontext.Context) (int, bool) {
+	priority, ok := rctx.Value(priorityKey{}).(int)
+	return priority, ok
+}
+
+// GetMetadata retrieves the hypervisor's metadata
+func (ctx *Context) GetMetadata() (map[string]string, error) {
 	metadata := make(map[string]string)
 
 	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
@@ -170,7 +283,24 @@ func getMetadata(w http.ResponseWriter, r *http.Request) {
 			return nil
 		})
 	})
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// isDryRun reports whether a request asks for the plan of an action rather
+// than running it
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	return dryRun
+}
 
+func getMetadata(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := getContext(r)
+
+	metadata, err := ctx.GetMetadata()
 	if err != nil {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
@@ -238,6 +368,17 @@ func (hr *HTTPResponse) JSONError(code int, err error) {
 	hr.JSON(code, httpError)
 }
 
+// processError writes the error from running or queueing an action. An action
+// rejected because the queue is full is answered with 503 and a Retry-After
+// header rather than the given code.
+func (hr *HTTPResponse) processError(code int, err error) {
+	if err == ErrQueueFull {
+		hr.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+		code = http.StatusServiceUnavailable
+	}
+	hr.JSONError(code, err)
+}
+
 // NewHTTPError prepares an HTTPError with a stack trace
 func NewHTTPError(code int, err error) *HTTPError {
 	httpError := &HTTPError{
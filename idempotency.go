@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mistifyio/kvite"
+)
+
+type (
+	// idempotentResponse is the response saved for an idempotency key
+	idempotentResponse struct {
+		JobID     string
+		Code      int
+		Body      []byte
+		CreatedAt time.Time
+	}
+
+	// idempotencyRecorder captures a response so it can be saved
+	idempotencyRecorder struct {
+		http.ResponseWriter
+		code int
+		body bytes.Buffer
+	}
+)
+
+const (
+	// IdempotencyKeyHeader is the request header a client may use to safely
+	// retry a request that starts a job. A repeated key within the configured
+	// window returns the original response instead of starting a new job.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayHeader is set on responses replayed for a repeated
+	// idempotency key
+	IdempotentReplayHeader = "Idempotent-Replayed"
+)
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// idempotencyMiddleware replays the saved response for a repeated
+// Idempotency-Key. Only requests that may start a job are considered, and only
+// successful responses that started one are saved.
+func idempotencyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hr := &HTTPResponse{w}
+		ctx := getContext(r)
+		key = fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, key)
+
+		if !ctx.reserveIdempotencyKey(key) {
+			hr.JSONError(http.StatusConflict, fmt.Errorf("a request with %s %s is already in progress", IdempotencyKeyHeader, r.Header.Get(IdempotencyKeyHeader)))
+			return
+		}
+		defer ctx.releaseIdempotencyKey(key)
+
+		saved, err := ctx.getIdempotentResponse(key)
+		if err != nil {
+			hr.JSONError(http.StatusInternalServerError, err)
+			return
+		}
+		if saved != nil {
+			hr.Header().Set("Content-Type", "application/json")
+			hr.Header().Set("X-Guest-Job-ID", saved.JobID)
+			hr.Header().Set(IdempotentReplayHeader, "true")
+			hr.WriteHeader(saved.Code)
+			_, _ = hr.Write(saved.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		jobID := rec.Header().Get("X-Guest-Job-ID")
+		if jobID == "" || rec.code < 200 || rec.code >= 300 {
+			return
+		}
+		saved = &idempotentResponse{
+			JobID:     jobID,
+			Code:      rec.code,
+			Body:      rec.body.Bytes(),
+			CreatedAt: time.Now(),
+		}
+		if err := ctx.saveIdempotentResponse(key, saved); err != nil {
+			log.WithFields(log.Fields{
+				"job":   jobID,
+				"error": err,
+				"func":  "agent.Context.saveIdempotentResponse",
+			}).Error("failed to save idempotent response")
+		}
+	})
+}
+
+// reserveIdempotencyKey marks a key as in use by a request, returning false if
+// another request already holds it
+func (ctx *Context) reserveIdempotencyKey(key string) bool {
+	ctx.idempotencyMutex.Lock()
+	defer ctx.idempotencyMutex.Unlock()
+
+	if ctx.idempotencyKeys[key] {
+		return false
+	}
+	ctx.idempotencyKeys[key] = true
+	return true
+}
+
+// releaseIdempotencyKey marks a key as no longer in use by a request
+func (ctx *Context) releaseIdempotencyKey(key string) {
+	ctx.idempotencyMutex.Lock()
+	defer ctx.idempotencyMutex.Unlock()
+
+	delete(ctx.idempotencyKeys, key)
+}
+
+// idempotencyWindow is how long a response is saved for its key
+func (ctx *Context) idempotencyWindow() time.Duration {
+	return time.Duration(ctx.Config.IdempotencyWindow) * time.Second
+}
+
+// getIdempotentResponse looks up the saved response for a key. Nil is
+// returned if there is none or it has expired.
+func (ctx *Context) getIdempotentResponse(key string) (*idempotentResponse, error) {
+	var saved *idempotentResponse
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("idempotency_keys")
+		if err != nil {
+			return err
+		}
+		data, err := b.Get(key)
+		if err != nil || data == nil {
+			return err
+		}
+		saved = &idempotentResponse{}
+		return json.Unmarshal(data, saved)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if saved != nil && time.Since(saved.CreatedAt) > ctx.idempotencyWindow() {
+		return nil, nil
+	}
+	return saved, nil
+}
+
+// saveIdempotentResponse saves the response for a key, removing any expired
+// keys along the way
+func (ctx *Context) saveIdempotentResponse(key string, saved *idempotentResponse) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket("idempotency_keys")
+		if err != nil {
+			return err
+		}
+
+		var expired []string
+		err = b.ForEach(func(k string, v []byte) error {
+			var old idempotentResponse
+			if err := json.Unmarshal(v, &old); err != nil || time.Since(old.CreatedAt) > ctx.idempotencyWindow() {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return b.Put(key, data)
+	})
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -10,7 +11,7 @@ import (
 	"github.com/mistifyio/mistify-agent/rpc"
 )
 
-func imageMultiQuery(ctx *Context, actionBaseName string, desiredImageType string, request *rpc.ImageRequest) ([]*rpc.Image, *HTTPError) {
+func imageMultiQuery(rctx context.Context, ctx *Context, actionBaseName string, desiredImageType string, request *rpc.ImageRequest) ([]*rpc.Image, *HTTPError) {
 	// Determine the set of actions to query based on desired image type
 	imageTypes := []string{"", "container"}
 	if desiredImageType != "" {
@@ -31,7 +32,7 @@ func imageMultiQuery(ctx *Context, actionBaseName string, desiredImageType strin
 	// Query in parallel
 	for _, imageType := range imageTypes {
 		actionName := prefixedActionName(imageType, actionBaseName)
-		go imageQuery(runner, actionName, request, resps, errors)
+		go imageQuery(rctx, runner, actionName, request, resps, errors)
 	}
 
 	// Wait for all to finish and aggregate results
@@ -55,7 +56,7 @@ func imageMultiQuery(ctx *Context, actionBaseName string, desiredImageType strin
 	return images, nil
 }
 
-func imageQuery(runner *GuestRunner, actionName string, request *rpc.ImageRequest, respChan chan *rpc.ImageResponse, errChan chan error) {
+func imageQuery(rctx context.Context, runner *GuestRunner, actionName string, request *rpc.ImageRequest, respChan chan *rpc.ImageResponse, errChan chan error) {
 	response := &rpc.ImageResponse{}
 
 	action, err := runner.Context.GetAction(actionName)
@@ -65,7 +66,7 @@ func imageQuery(runner *GuestRunner, actionName string, request *rpc.ImageReques
 	}
 	pipeline := action.GeneratePipeline(request, response, nil, nil)
 
-	if err = runner.Process(pipeline); err != nil {
+	if err = runner.Process(rctx, pipeline); err != nil {
 		errChan <- err
 		return
 	}
@@ -79,7 +80,7 @@ func listImages(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	request := &rpc.ImageRequest{}
-	images, err := imageMultiQuery(ctx, "listImages", vars["type"], request)
+	images, err := imageMultiQuery(r.Context(), ctx, "listImages", vars["type"], request)
 	if err != nil {
 		hr.JSON(err.Code, err)
 		return
@@ -95,7 +96,7 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 	request := &rpc.ImageRequest{
 		ID: vars["id"],
 	}
-	images, err := imageMultiQuery(ctx, "getImage", "", request)
+	images, err := imageMultiQuery(r.Context(), ctx, "getImage", "", request)
 	if err != nil {
 		hr.JSON(err.Code, err)
 		return
@@ -131,7 +132,7 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 
 	// First find the image in order to know the type and, therefore, what
 	// specific action to use to delete it
-	images, mqErr := imageMultiQuery(ctx, "getImage", "", request)
+	images, mqErr := imageMultiQuery(r.Context(), ctx, "getImage", "", request)
 	if mqErr != nil {
 		hr.JSON(mqErr.Code, mqErr)
 		return
@@ -160,7 +161,6 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
-	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
 
 	runner, err := ctx.GetAgentRunner()
 	if err != nil {
@@ -168,9 +168,11 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := runner.Process(pipeline); err != nil {
+	err = runner.Process(r.Context(), pipeline)
+	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
+	if err != nil {
 		// how to check for not found??
-		hr.JSONError(http.StatusInternalServerError, err)
+		hr.processError(http.StatusInternalServerError, err)
 		return
 	}
 	hr.JSON(http.StatusAccepted, struct{}{})
@@ -198,7 +200,6 @@ func fetchImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
-	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
 
 	runner, err := ctx.GetAgentRunner()
 	if err != nil {
@@ -206,8 +207,10 @@ func fetchImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := runner.Process(pipeline); err != nil {
-		hr.JSONError(http.StatusInternalServerError, err)
+	err = runner.Process(r.Context(), pipeline)
+	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
+	if err != nil {
+		hr.processError(http.StatusInternalServerError, err)
 		return
 	}
 
@@ -0,0 +1,213 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// currentArchive is the archive file pruned jobs are added to. Once it
+	// is full, it is renamed with the time it was rotated.
+	currentArchive = "jobs.jsonl.gz"
+	// rotatedArchives matches the archive files that have been rotated
+	rotatedArchives = "jobs-*.jsonl.gz"
+)
+
+// ErrNoArchive is the error for reading archived jobs when no archive is
+// configured
+var ErrNoArchive = errors.New("job archive is not configured")
+
+// archiveJobs adds pruned jobs to the current archive file as JSON Lines,
+// rotating it first if it is full. Each batch is written as its own gzip
+// member, which readers see as one stream. Jobs are not archived if no archive
+// directory is configured.
+func (ctx *Context) archiveJobs(jobs []*Job) error {
+	retention := ctx.Config.JobRetention
+	if retention.ArchiveDir == "" || len(jobs) == 0 {
+		return nil
+	}
+	ctx.archiveMutex.Lock()
+	defer ctx.archiveMutex.Unlock()
+
+	if err := os.MkdirAll(retention.ArchiveDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(retention.ArchiveDir, currentArchive)
+	if info, err := os.Stat(path); err == nil && uint(info.Size()) >= retention.ArchiveMaxSize {
+		if err := ctx.rotateArchive(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	for _, job := range jobs {
+		if err := encoder.Encode(job); err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// rotateArchive renames the current archive file and removes the oldest
+// rotated files beyond the configured number. Must be called with archiveMutex
+// held.
+func (ctx *Context) rotateArchive() error {
+	retention := ctx.Config.JobRetention
+	path := filepath.Join(retention.ArchiveDir, currentArchive)
+	rotated := filepath.Join(retention.ArchiveDir, fmt.Sprintf("jobs-%d.jsonl.gz", time.Now().UnixNano()))
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+
+	files, err := ctx.archiveFiles()
+	if err != nil {
+		return err
+	}
+	// The current file will be created again, and counts towards the limit
+	for len(files) > 0 && uint(len(files)) >= retention.ArchiveMaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// archiveFiles lists the archive files, oldest first. Must be called with
+// archiveMutex held.
+func (ctx *Context) archiveFiles() ([]string, error) {
+	dir := ctx.Config.JobRetention.ArchiveDir
+	files, err := filepath.Glob(filepath.Join(dir, rotatedArchives))
+	if err != nil {
+		return nil, err
+	}
+	// Rotated files are named with when they were rotated
+	sort.Strings(files)
+	path := filepath.Join(dir, currentArchive)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// GetArchivedJobs reads the archived jobs matching a query, newest first.
+// Files are read newest first, and reading stops once the limit is reached.
+// Cursors are not supported for archived jobs.
+func (ctx *Context) GetArchivedJobs(query *JobQuery) ([]*Job, error) {
+	if ctx.Config.JobRetention.ArchiveDir == "" {
+		return nil, ErrNoArchive
+	}
+	ctx.archiveMutex.Lock()
+	defer ctx.archiveMutex.Unlock()
+
+	files, err := ctx.archiveFiles()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0)
+	for i := len(files) - 1; i >= 0; i-- {
+		limit := 0
+		if query.Limit > 0 {
+			if limit = query.Limit - len(jobs); limit == 0 {
+				break
+			}
+		}
+		matched, err := readArchive(files[i], query, limit)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, matched...)
+	}
+	return jobs, nil
+}
+
+// readArchive reads the jobs in an archive file that match a query, newest
+// first. Jobs are written oldest first, so with a limit, only the latest
+// matches seen so far are held while the file is read.
+func readArchive(path string, query *JobQuery, limit int) ([]*Job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	defer gz.Close()
+
+	// With a limit, matches wrap around once it is reached, overwriting the
+	// oldest
+	matched := make([]*Job, 0)
+	count := 0
+	decoder := json.NewDecoder(gz)
+	for {
+		var job Job
+		if err := decoder.Decode(&job); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if !query.matches(&job) {
+			continue
+		}
+		if limit > 0 && len(matched) == limit {
+			matched[count%limit] = &job
+		} else {
+			matched = append(matched, &job)
+		}
+		count++
+	}
+
+	jobs := make([]*Job, len(matched))
+	for i := range jobs {
+		// The newest match is the last one written
+		jobs[i] = matched[(count-1-i)%len(matched)]
+	}
+	return jobs, nil
+}
+
+// getArchivedJobs lists archived jobs, filtered by the same request parameters
+// as the job log, for a guest if the route has one
+func getArchivedJobs(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	query, format, err := parseJobsRequest(r, mux.Vars(r)["id"])
+	if err == nil && query.Cursor != "" {
+		err = errors.New("cursor is not supported for archived jobs")
+	}
+	if err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	jobs, err := ctx.GetArchivedJobs(query)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrNoArchive {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
+		return
+	}
+	hr.writeJobList(format, jobs)
+}
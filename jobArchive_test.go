@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mistifyio/mistify-agent/config"
+)
+
+// writeTestArchive writes jobs to an archive file in batches, each as its own
+// gzip member like archiveJobs does
+func writeTestArchive(t *testing.T, path string, batches ...[]*Job) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, batch := range batches {
+		gz := gzip.NewWriter(f)
+		encoder := json.NewEncoder(gz)
+		for _, job := range batch {
+			if err := encoder.Encode(job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jobs := testJobLog(8).Jobs
+	path := filepath.Join(dir, currentArchive)
+	writeTestArchive(t, path, jobs[:3], jobs[3:])
+
+	tests := []struct {
+		name  string
+		query *JobQuery
+		limit int
+		want  string
+	}{
+		{"all", &JobQuery{}, 0, "hgfedcba"},
+		{"limit", &JobQuery{}, 3, "hgf"},
+		{"limit over count", &JobQuery{}, 20, "hgfedcba"},
+		{"limit of one", &JobQuery{}, 1, "h"},
+		{"filtered", &JobQuery{GuestID: "g1"}, 0, "geca"},
+		{"filtered limit", &JobQuery{GuestID: "g1"}, 3, "gec"},
+		{"no matches", &JobQuery{GuestID: "g3"}, 2, ""},
+	}
+	for _, test := range tests {
+		got, err := readArchive(path, test.query, test.limit)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if ids := jobIDs(got); ids != test.want {
+			t.Errorf("%s: got jobs %s, want %s", test.name, ids, test.want)
+		}
+	}
+}
+
+func TestReadArchiveCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, currentArchive)
+	if err := ioutil.WriteFile(path, []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readArchive(path, &JobQuery{}, 0); err == nil {
+		t.Error("readArchive should fail for a corrupt file")
+	}
+}
+
+func TestGetArchivedJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Rotated files are older than the current one
+	jobs := testJobLog(8).Jobs
+	writeTestArchive(t, filepath.Join(dir, "jobs-1.jsonl.gz"), jobs[:2])
+	writeTestArchive(t, filepath.Join(dir, "jobs-2.jsonl.gz"), jobs[2:5])
+	writeTestArchive(t, filepath.Join(dir, currentArchive), jobs[5:])
+
+	ctx := &Context{Config: config.NewConfig()}
+	ctx.Config.JobRetention.ArchiveDir = dir
+	tests := []struct {
+		query *JobQuery
+		want  string
+	}{
+		{&JobQuery{}, "hgfedcba"},
+		{&JobQuery{Limit: 2}, "hg"},
+		{&JobQuery{Limit: 4}, "hgfe"},
+		{&JobQuery{GuestID: "g2", Limit: 3}, "hfd"},
+	}
+	for _, test := range tests {
+		got, err := ctx.GetArchivedJobs(test.query)
+		if err != nil {
+			t.Errorf("%+v: %s", test.query, err)
+			continue
+		}
+		if ids := jobIDs(got); ids != test.want {
+			t.Errorf("%+v: got jobs %s, want %s", test.query, ids, test.want)
+		}
+	}
+
+	ctx.Config.JobRetention.ArchiveDir = ""
+	if _, err := ctx.GetArchivedJobs(&JobQuery{}); err != ErrNoArchive {
+		t.Errorf("got error %v, want %v", err, ErrNoArchive)
+	}
+}
@@ -2,13 +2,15 @@ package agent
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mistifyio/kvite"
+	"github.com/mistifyio/mistify-agent/config"
 )
 
 type (
@@ -20,11 +22,28 @@ type (
 		ID        string
 		GuestID   string
 		Action    string
+		Priority  int
 		QueuedAt  time.Time
 		StartedAt time.Time
 		UpdatedAt time.Time
 		Status    JobStatus
 		Message   string
+		Attempts  []*StageAttempt
+		Rollbacks []*StageRollback
+		Skipped   []string // Stages skipped by their when condition
+		Hooks     []*HookRun
+		Coalesced []time.Time // When identical requests were merged into the job
+		Stages    []*StageProgress
+		// CurrentStage is the index of the stage being run, or of the last
+		// stage run once the job is finished. It is -1 until a stage starts.
+		CurrentStage int
+		StageCount   int
+		// Recovery is the ID of the job run to recover from the job being
+		// interrupted, if any
+		Recovery       string
+		Schedule       string // ID of the schedule that queued the job, if any
+		SnapshotPolicy string // Name of the snapshot policy that queued the job, if any
+		Callbacks      []*CallbackDelivery
 	}
 
 	// JobLog holds the most recent jobs for a guest
@@ -39,8 +58,6 @@ type (
 )
 
 const (
-	// MaxLoggedJobs configures how many jobs to prune the log to
-	MaxLoggedJobs int = 1000
 	// Queued is the queued job status
 	Queued JobStatus = "Queued"
 	// Running is the running job status
@@ -49,6 +66,11 @@ const (
 	Complete JobStatus = "Complete"
 	// Errored is the errored job status
 	Errored JobStatus = "Error"
+	// Cancelled is the cancelled job status
+	Cancelled JobStatus = "Cancelled"
+	// Interrupted is the status of a job that was running when the agent
+	// stopped
+	Interrupted JobStatus = "Interrupted"
 )
 
 // reindex rebuilds the job id index for a job log. Must be called with
@@ -135,25 +157,67 @@ func (jobLog *JobLog) GetLatestGuestJobs(guestID string, limit int) []*Job {
 	return jobs
 }
 
+// getJobsByStatus returns the jobs in the log with a status, oldest first
+func (jobLog *JobLog) getJobsByStatus(status JobStatus) []*Job {
+	jobLog.ModifyMutex.RLock()
+	defer jobLog.ModifyMutex.RUnlock()
+
+	var jobs []*Job
+	for _, job := range jobLog.Jobs {
+		if job.Status == status {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// getJobsWithPendingCallbacks returns the finished jobs in the log that have
+// callbacks not yet delivered, oldest first
+func (jobLog *JobLog) getJobsWithPendingCallbacks() []*Job {
+	jobLog.ModifyMutex.RLock()
+	defer jobLog.ModifyMutex.RUnlock()
+
+	var jobs []*Job
+	for _, job := range jobLog.Jobs {
+		if job.Status == Queued || job.Status == Running {
+			continue
+		}
+		for _, delivery := range job.Callbacks {
+			if delivery.Status == CallbackPending {
+				jobs = append(jobs, job)
+				break
+			}
+		}
+	}
+	return jobs
+}
+
 // AddJob adds a job to the log
-func (jobLog *JobLog) AddJob(jobID, guestID, action string) error {
+func (jobLog *JobLog) AddJob(jobID, guestID, action string, priority int) error {
 	jobLog.ModifyMutex.Lock()
 	defer jobLog.ModifyMutex.Unlock()
 
 	job := &Job{
-		ID:        jobID,
-		GuestID:   guestID,
-		Action:    action,
-		QueuedAt:  time.Now(),
-		UpdatedAt: time.Now(),
-		Status:    Queued,
+		ID:           jobID,
+		GuestID:      guestID,
+		Action:       action,
+		Priority:     priority,
+		QueuedAt:     time.Now(),
+		UpdatedAt:    time.Now(),
+		Status:       Queued,
+		CurrentStage: -1,
 	}
 
 	// Add and index
 	jobLog.Jobs = append(jobLog.Jobs, job)
 	jobLog.addIndex(job, len(jobLog.Jobs)-1)
+	jobLog.Context.captureJobOutput(jobID)
 
-	return jobLog.persist()
+	if err := jobLog.persist(); err != nil {
+		return err
+	}
+	jobLog.Context.Events.Publish(JobQueuedEvent, guestID, newJobEvent(job))
+	return nil
 }
 
 // UpdateJob updates a job's status and timing information
@@ -171,6 +235,185 @@ func (jobLog *JobLog) UpdateJob(jobID string, action string, status JobStatus, m
 		job.StartedAt = time.Now()
 	}
 	job.Message = message
+	if err := jobLog.persist(); err != nil {
+		return err
+	}
+	jobLog.Context.Events.Publish(JobUpdatedEvent, job.GuestID, newJobEvent(job))
+	if status != Queued && status != Running {
+		jobLog.Context.finishJobOutput(jobID)
+	}
+	return nil
+}
+
+// SetRecovery records the job run to recover from a job being interrupted
+func (jobLog *JobLog) SetRecovery(jobID string, recoveryID string) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Recovery = recoveryID
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// SetSchedule records the schedule that queued a job
+func (jobLog *JobLog) SetSchedule(jobID string, scheduleID string) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Schedule = scheduleID
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// SetSnapshotPolicy records the snapshot policy that queued a job
+func (jobLog *JobLog) SetSnapshotPolicy(jobID string, policy string) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.SnapshotPolicy = policy
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// AddCallbacks records callbacks to be delivered once a job finishes
+func (jobLog *JobLog) AddCallbacks(jobID string, callbacks []*Callback) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	for _, callback := range callbacks {
+		job.Callbacks = append(job.Callbacks, &CallbackDelivery{
+			URL:    callback.URL,
+			Status: CallbackPending,
+		})
+	}
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// UpdateCallback records the delivery of one of a job's callbacks, by index
+func (jobLog *JobLog) UpdateCallback(jobID string, i int, delivery *CallbackDelivery) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	if i < 0 || i >= len(job.Callbacks) {
+		return ErrNotFound
+	}
+	job.Callbacks[i] = delivery
+	return jobLog.persist()
+}
+
+// AddAttempt records a stage attempt for a job. Attempts are saved along with
+// the next persisted change to the job log, such as the stage finishing, rather
+// than saving the whole log for each one.
+func (jobLog *JobLog) AddAttempt(jobID string, attempt *StageAttempt) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Attempts = append(job.Attempts, attempt)
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+// AddRollback records a stage compensation for a job
+func (jobLog *JobLog) AddRollback(jobID string, rollback *StageRollback) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Rollbacks = append(job.Rollbacks, rollback)
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// AddSkipped records a stage that was skipped for a job
+func (jobLog *JobLog) AddSkipped(jobID string, stage string) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Skipped = append(job.Skipped, stage)
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// AddCoalesced records that an identical request was merged into a job
+func (jobLog *JobLog) AddCoalesced(jobID string) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Coalesced = append(job.Coalesced, time.Now())
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// AddHookRun records a hook stage run for a job
+func (jobLog *JobLog) AddHookRun(jobID string, run *HookRun) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.Hooks = append(job.Hooks, run)
+	job.UpdatedAt = time.Now()
+	return jobLog.persist()
+}
+
+// UpdateStage records the progress of a stage for a job, replacing any earlier
+// progress for the same stage or parallel group member
+func (jobLog *JobLog) UpdateStage(jobID string, stageCount int, progress *StageProgress) error {
+	jobLog.ModifyMutex.Lock()
+	defer jobLog.ModifyMutex.Unlock()
+
+	job, err := jobLog.getJob(jobID)
+	if err != nil {
+		return err
+	}
+	job.CurrentStage = progress.Index
+	job.StageCount = stageCount
+	job.UpdatedAt = time.Now()
+	for i, stage := range job.Stages {
+		if stage.Index == progress.Index && stage.Member == progress.Member {
+			job.Stages[i] = progress
+			return jobLog.persist()
+		}
+	}
+	job.Stages = append(job.Stages, progress)
 	return jobLog.persist()
 }
 
@@ -197,66 +440,105 @@ func (jobLog *JobLog) Persist() error {
 	return jobLog.persist()
 }
 
-// prune trims the job log to the max length
+// prune removes finished jobs beyond the configured retention, archiving them
+// if an archive is configured. Jobs are kept newest first, up to the limits for
+// their guest and for all guests. Queued and running jobs are never removed,
+// but count towards the limits.
 func (jobLog *JobLog) prune() error {
 	jobLog.ModifyMutex.Lock()
 	defer jobLog.ModifyMutex.Unlock()
 
-	n := len(jobLog.Jobs)
-	if n <= MaxLoggedJobs {
+	retention := jobLog.Context.Config.JobRetention
+	maxJobs := config.Limit(retention.MaxJobs)
+	maxGuestJobs := config.Limit(retention.MaxGuestJobs)
+	var cutoff time.Time
+	if maxAge := config.Limit(retention.MaxAge); maxAge != 0 {
+		cutoff = time.Now().Add(-time.Duration(maxAge) * time.Second)
+	}
+
+	keep := make([]bool, len(jobLog.Jobs))
+	guestCounts := make(map[string]uint)
+	var count uint
+	pruned := 0
+	for i := len(jobLog.Jobs) - 1; i >= 0; i-- {
+		job := jobLog.Jobs[i]
+		active := job.Status == Queued || job.Status == Running
+		expired := !cutoff.IsZero() && job.UpdatedAt.Before(cutoff)
+		overGuest := maxGuestJobs != 0 && guestCounts[job.GuestID] >= maxGuestJobs
+		overAll := maxJobs != 0 && count >= maxJobs
+		if !active && (expired || overGuest || overAll) {
+			pruned++
+			continue
+		}
+		keep[i] = true
+		guestCounts[job.GuestID]++
+		count++
+	}
+	if pruned == 0 {
 		return nil
 	}
 
-	jobLog.Jobs = jobLog.Jobs[n-MaxLoggedJobs:]
+	jobs := make([]*Job, 0, len(jobLog.Jobs)-pruned)
+	archived := make([]*Job, 0, pruned)
+	for i, job := range jobLog.Jobs {
+		if keep[i] {
+			jobs = append(jobs, job)
+		} else {
+			archived = append(archived, job)
+		}
+	}
+	// Jobs are only dropped once they are safely archived
+	if err := jobLog.Context.archiveJobs(archived); err != nil {
+		return err
+	}
+	if err := jobLog.Context.deleteJobOutputs(archived); err != nil {
+		return err
+	}
+	jobLog.Jobs = jobs
 	jobLog.reindex()
 	return jobLog.persist()
 }
 
+// getLatestGuestJobs lists the jobs for a guest, filtered and paged by the
+// request parameters
 func getLatestGuestJobs(w http.ResponseWriter, r *http.Request) {
-	hr := HTTPResponse{w}
-	ctx := getContext(r)
-	vars := mux.Vars(r)
-
-	jobLog := ctx.JobLog
-	limitParam := vars["limit"]
-	limit := MaxLoggedJobs
-	if limitParam != "" {
-		var err error
-		limit, err = strconv.Atoi(limitParam)
-		if err != nil {
-			hr.JSONError(http.StatusBadRequest, err)
-			return
-		}
-	}
-	hr.JSON(http.StatusOK, jobLog.GetLatestJobs(limit))
+	writeJobs(w, r, mux.Vars(r)["id"])
 }
 
+// getLatestJobs lists the jobs for all guests, filtered and paged by the
+// request parameters
 func getLatestJobs(w http.ResponseWriter, r *http.Request) {
+	writeJobs(w, r, "")
+}
+
+func getJobStatus(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 	ctx := getContext(r)
 	vars := mux.Vars(r)
 
 	jobLog := ctx.JobLog
-	limitParam := vars["limit"]
-	limit := MaxLoggedJobs
-	if limitParam != "" {
-		var err error
-		limit, err = strconv.Atoi(limitParam)
-		if err != nil {
-			hr.JSONError(http.StatusBadRequest, err)
-			return
+	job, err := jobLog.GetJob(vars["jobID"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrNotFound {
+			code = http.StatusNotFound
 		}
+		hr.JSONError(code, err)
+		return
 	}
-	hr.JSON(http.StatusOK, jobLog.GetLatestJobs(limit))
+	hr.JSON(http.StatusOK, job)
 }
 
-func getJobStatus(w http.ResponseWriter, r *http.Request) {
+func cancelJob(w http.ResponseWriter, r *http.Request) {
 	hr := HTTPResponse{w}
 	ctx := getContext(r)
 	vars := mux.Vars(r)
 
 	jobLog := ctx.JobLog
 	job, err := jobLog.GetJob(vars["jobID"])
+	if err == nil && vars["id"] != "" && job.GuestID != vars["id"] {
+		err = ErrNotFound
+	}
 	if err != nil {
 		code := http.StatusInternalServerError
 		if err == ErrNotFound {
@@ -265,5 +547,33 @@ func getJobStatus(w http.ResponseWriter, r *http.Request) {
 		hr.JSONError(code, err)
 		return
 	}
-	hr.JSON(http.StatusOK, job)
+
+	runner, err := ctx.GetGuestRunner(job.GuestID)
+	if err == nil {
+		err = runner.Async.Cancel(job.ID)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			// The job may have finished since it was looked up
+			if current, getErr := jobLog.GetJob(job.ID); getErr == nil {
+				job = current
+			}
+			err = fmt.Errorf("job is %s and cannot be cancelled", strings.ToLower(string(job.Status)))
+		}
+		hr.JSONError(http.StatusConflict, err)
+		return
+	}
+
+	// A running job stops once its current stage is interrupted and any
+	// completed stages are compensated
+	job, err = jobLog.GetJob(job.ID)
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	code := http.StatusAccepted
+	if job.Status == Cancelled {
+		code = http.StatusOK
+	}
+	hr.JSON(code, job)
 }
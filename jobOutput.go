@@ -0,0 +1,283 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/kvite"
+)
+
+type (
+	// JobLogLine is a line logged for a job while it was queued or running
+	JobLogLine struct {
+		Time    time.Time
+		Level   string // info or error
+		Runner  string
+		Message string
+	}
+
+	// jobOutput collects the log lines of an active job
+	jobOutput struct {
+		mutex   sync.Mutex
+		lines   []*JobLogLine
+		done    bool
+		changed chan struct{} // Closed when a line is added or the job finishes
+	}
+
+	// jobOutputs captures runner log lines for the jobs being captured, by job
+	// ID. It is added to the logger as a hook, since runner logs are written
+	// without a Context.
+	jobOutputs struct {
+		mutex   sync.Mutex
+		outputs map[string]*jobOutput
+	}
+)
+
+const (
+	jobLogsBucket = "job_logs"
+
+	// maxJobLogLines limits how many lines are kept for a job. Later lines are
+	// dropped.
+	maxJobLogLines = 1000
+)
+
+// captureJobOutput starts capturing the log lines of a job
+func (ctx *Context) captureJobOutput(jobID string) {
+	output := &jobOutput{
+		lines:   make([]*JobLogLine, 0),
+		changed: make(chan struct{}),
+	}
+
+	ctx.jobOutputs.mutex.Lock()
+	defer ctx.jobOutputs.mutex.Unlock()
+	if _, ok := ctx.jobOutputs.outputs[jobID]; !ok {
+		ctx.jobOutputs.outputs[jobID] = output
+	}
+}
+
+// finishJobOutput stops capturing the log lines of a job once it is finished,
+// and saves them. The output is only forgotten once the lines are saved, so
+// they can always be read from one or the other.
+func (ctx *Context) finishJobOutput(jobID string) {
+	ctx.jobOutputs.mutex.Lock()
+	output, ok := ctx.jobOutputs.outputs[jobID]
+	ctx.jobOutputs.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	output.mutex.Lock()
+	output.done = true
+	lines := output.lines
+	output.mutex.Unlock()
+
+	if err := ctx.persistJobOutput(jobID, lines); err != nil {
+		// Logged without the runner fields, so it is not captured
+		log.WithField("pipeline", jobID).Error("saving job output: " + err.Error())
+	}
+
+	ctx.jobOutputs.mutex.Lock()
+	delete(ctx.jobOutputs.outputs, jobID)
+	ctx.jobOutputs.mutex.Unlock()
+	// Followers are woken once the lines can be read back
+	output.mutex.Lock()
+	close(output.changed)
+	output.mutex.Unlock()
+}
+
+// Levels returns the levels of the runner log lines that are captured
+func (outputs *jobOutputs) Levels() []log.Level {
+	return []log.Level{log.ErrorLevel, log.InfoLevel}
+}
+
+// Fire adds a runner log line to its job's output if it is being captured.
+// It is called with the logger locked, so must not log.
+func (outputs *jobOutputs) Fire(entry *log.Entry) error {
+	jobID, _ := entry.Data["pipeline"].(string)
+	runner, ok := entry.Data["runner"].(string)
+	if jobID == "" || !ok {
+		return nil
+	}
+	outputs.mutex.Lock()
+	output, ok := outputs.outputs[jobID]
+	outputs.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	if output.done || len(output.lines) >= maxJobLogLines {
+		return nil
+	}
+	output.lines = append(output.lines, &JobLogLine{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Runner:  runner,
+		Message: entry.Message,
+	})
+	close(output.changed)
+	output.changed = make(chan struct{})
+	return nil
+}
+
+// persistJobOutput saves the log lines of a job
+func (ctx *Context) persistJobOutput(jobID string, lines []*JobLogLine) error {
+	data, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(jobLogsBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(jobID, data)
+	})
+}
+
+// loadJobOutput retrieves the saved log lines of a job
+func (ctx *Context) loadJobOutput(jobID string) ([]*JobLogLine, error) {
+	lines := make([]*JobLogLine, 0)
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(jobLogsBucket)
+		if err != nil {
+			return err
+		}
+		data, err := b.Get(jobID)
+		if err != nil || data == nil {
+			return err
+		}
+		return json.Unmarshal(data, &lines)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// deleteJobOutputs removes the saved log lines of jobs pruned from the job log
+func (ctx *Context) deleteJobOutputs(jobs []*Job) error {
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(jobLogsBucket)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if err := b.Delete(job.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetJobOutput returns the log lines of a job from the given offset. If the
+// job is still active, a channel is returned that is closed once there are
+// more lines or the job finishes. The channel is nil once the job is finished.
+func (ctx *Context) GetJobOutput(jobID string, offset int) ([]*JobLogLine, <-chan struct{}, error) {
+	ctx.jobOutputs.mutex.Lock()
+	output, ok := ctx.jobOutputs.outputs[jobID]
+	ctx.jobOutputs.mutex.Unlock()
+
+	var lines []*JobLogLine
+	var changed chan struct{}
+	if ok {
+		output.mutex.Lock()
+		lines = output.lines
+		if !output.done {
+			changed = output.changed
+		}
+		output.mutex.Unlock()
+	} else {
+		var err error
+		if lines, err = ctx.loadJobOutput(jobID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if offset > len(lines) {
+		offset = len(lines)
+	}
+	tail := make([]*JobLogLine, len(lines)-offset)
+	copy(tail, lines[offset:])
+	return tail, changed, nil
+}
+
+// getJobLogs returns the log lines captured for a job. With follow set, lines
+// are streamed as JSON Lines until the job finishes.
+func getJobLogs(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	vars := mux.Vars(r)
+
+	if r.Method != "GET" {
+		hr.JSONError(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	follow := false
+	if value := r.URL.Query().Get("follow"); value != "" {
+		var err error
+		if follow, err = strconv.ParseBool(value); err != nil {
+			hr.JSONError(http.StatusBadRequest, fmt.Errorf("invalid follow: %s", err))
+			return
+		}
+	}
+
+	job, err := ctx.JobLog.GetJob(vars["jobID"])
+	if err == nil && vars["id"] != "" && job.GuestID != vars["id"] {
+		err = ErrNotFound
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrNotFound {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
+		return
+	}
+
+	lines, changed, err := ctx.GetJobOutput(job.ID, 0)
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	if !follow {
+		hr.JSON(http.StatusOK, lines)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	hr.Header().Set("Content-Type", "application/x-ndjson")
+	hr.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(hr)
+	offset := 0
+	for {
+		for _, line := range lines {
+			if err := encoder.Encode(line); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		offset += len(lines)
+		if changed == nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		if lines, changed, err = ctx.GetJobOutput(job.ID, offset); err != nil {
+			return
+		}
+	}
+}
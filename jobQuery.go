@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// JobQuery selects jobs from the job log. Empty fields match any job.
+	JobQuery struct {
+		GuestID  string
+		Statuses []JobStatus
+		Actions  []string
+		Since    time.Time // Queued at or after
+		Until    time.Time // Queued before
+		// Cursor is the ID of the last job of the previous page. Only jobs
+		// older than it are returned.
+		Cursor string
+		Limit  int // Maximum jobs to return, or 0 for no limit
+	}
+)
+
+// Job export formats, set with the format query parameter
+const (
+	jsonFormat      = "json"
+	jsonLinesFormat = "jsonl"
+	csvFormat       = "csv"
+)
+
+// NextCursorHeader is the response header holding the cursor for the next page
+// of jobs, if there is one
+const NextCursorHeader = "X-Next-Cursor"
+
+// ErrCursorExpired is the error for a cursor whose job has been pruned from the
+// job log
+var ErrCursorExpired = errors.New("cursor job is no longer in the job log")
+
+// jobCSVHeader are the columns of a CSV job export
+var jobCSVHeader = []string{
+	"ID", "GuestID", "Action", "Priority", "Status", "Message",
+	"QueuedAt", "StartedAt", "UpdatedAt", "Schedule", "SnapshotPolicy", "Recovery",
+}
+
+// matches reports whether a job passes the query's filters
+func (query *JobQuery) matches(job *Job) bool {
+	if query.GuestID != "" && job.GuestID != query.GuestID {
+		return false
+	}
+	if !query.Since.IsZero() && job.QueuedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !job.QueuedAt.Before(query.Until) {
+		return false
+	}
+	if len(query.Statuses) > 0 {
+		found := false
+		for _, status := range query.Statuses {
+			if strings.EqualFold(string(status), string(job.Status)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(query.Actions) > 0 {
+		found := false
+		for _, action := range query.Actions {
+			if action == job.Action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryJobs returns the jobs matching a query, newest first, along with the
+// cursor for the next page. The cursor is empty once there are no more jobs.
+func (jobLog *JobLog) QueryJobs(query *JobQuery) ([]*Job, string, error) {
+	jobLog.ModifyMutex.RLock()
+	defer jobLog.ModifyMutex.RUnlock()
+
+	// Positions in the log to search, oldest first
+	var positions []int
+	if query.GuestID != "" {
+		positions = jobLog.GuestIndex[query.GuestID]
+	} else {
+		positions = make([]int, len(jobLog.Jobs))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+
+	end := len(positions)
+	if query.Cursor != "" {
+		cursor, ok := jobLog.Index[query.Cursor]
+		if !ok {
+			return nil, "", ErrCursorExpired
+		}
+		end = sort.SearchInts(positions, cursor)
+	}
+
+	jobs := make([]*Job, 0)
+	next := ""
+	for i := end - 1; i >= 0; i-- {
+		job := jobLog.Jobs[positions[i]]
+		// Jobs are logged in the order they were queued
+		if !query.Since.IsZero() && job.QueuedAt.Before(query.Since) {
+			break
+		}
+		if !query.matches(job) {
+			continue
+		}
+		if query.Limit > 0 && len(jobs) == query.Limit {
+			next = jobs[len(jobs)-1].ID
+			break
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, next, nil
+}
+
+// parseJobQuery builds a job query from request parameters. Statuses and
+// actions may be repeated or comma separated, and times are RFC 3339.
+func parseJobQuery(params url.Values) (*JobQuery, error) {
+	query := &JobQuery{
+		GuestID: params.Get("guest"),
+		Cursor:  params.Get("cursor"),
+	}
+	for _, status := range splitParams(params["status"]) {
+		query.Statuses = append(query.Statuses, JobStatus(status))
+	}
+	query.Actions = splitParams(params["action"])
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid since: %s", err)
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, fmt.Errorf("invalid until: %s", err)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	return query, nil
+}
+
+// splitParams splits comma separated query parameter values
+func splitParams(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return split
+}
+
+// parseJobsRequest builds a job query and finds the export format for a
+// request. The guest ID, if set, overrides the guest parameter.
+func parseJobsRequest(r *http.Request, guestID string) (*JobQuery, string, error) {
+	params := r.URL.Query()
+	query, err := parseJobQuery(params)
+	if err != nil {
+		return nil, "", err
+	}
+	if guestID != "" {
+		query.GuestID = guestID
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = jsonFormat
+	}
+	if format != jsonFormat && format != jsonLinesFormat && format != csvFormat {
+		return nil, "", fmt.Errorf("invalid format %q", format)
+	}
+	return query, format, nil
+}
+
+// writeJobs queries the job log for a request and writes the jobs in the
+// requested format
+func writeJobs(w http.ResponseWriter, r *http.Request, guestID string) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	query, format, err := parseJobsRequest(r, guestID)
+	if err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	jobs, next, err := ctx.JobLog.QueryJobs(query)
+	if err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	if next != "" {
+		hr.Header().Set(NextCursorHeader, next)
+	}
+	hr.writeJobList(format, jobs)
+}
+
+// writeJobList writes jobs as a JSON array, JSON Lines, or CSV
+func (hr *HTTPResponse) writeJobList(format string, jobs []*Job) {
+	switch format {
+	case jsonLinesFormat:
+		hr.Header().Set("Content-Type", "application/x-ndjson")
+		hr.Header().Set("Content-Disposition", "attachment; filename=jobs.jsonl")
+		hr.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(hr)
+		for _, job := range jobs {
+			if err := encoder.Encode(job); err != nil {
+				return
+			}
+		}
+	case csvFormat:
+		hr.Header().Set("Content-Type", "text/csv")
+		hr.Header().Set("Content-Disposition", "attachment; filename=jobs.csv")
+		hr.WriteHeader(http.StatusOK)
+		writer := csv.NewWriter(hr)
+		_ = writer.Write(jobCSVHeader)
+		for _, job := range jobs {
+			_ = writer.Write(jobCSVRecord(job))
+		}
+		writer.Flush()
+	default:
+		hr.JSON(http.StatusOK, jobs)
+	}
+}
+
+// jobCSVRecord formats a job as a CSV row matching jobCSVHeader
+func jobCSVRecord(job *Job) []string {
+	return []string{
+		job.ID,
+		job.GuestID,
+		job.Action,
+		strconv.Itoa(job.Priority),
+		string(job.Status),
+		job.Message,
+		formatCSVTime(job.QueuedAt),
+		formatCSVTime(job.StartedAt),
+		formatCSVTime(job.UpdatedAt),
+		job.Schedule,
+		job.SnapshotPolicy,
+		job.Recovery,
+	}
+}
+
+// formatCSVTime formats a time for CSV, leaving unset times empty
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
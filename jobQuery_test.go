@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testJobLog creates a job log of jobs queued a minute apart, alternating
+// between two guests and two actions. Odd jobs are complete, even ones errored.
+func testJobLog(n int) *JobLog {
+	start := time.Date(2016, time.October, 16, 0, 0, 0, 0, time.UTC)
+	jobLog := &JobLog{}
+	for i := 0; i < n; i++ {
+		job := &Job{
+			ID:       string(rune('a' + i)),
+			GuestID:  []string{"g1", "g2"}[i%2],
+			Action:   []string{"start", "stop"}[i/2%2],
+			Status:   []JobStatus{Errored, Complete}[i%2],
+			QueuedAt: start.Add(time.Duration(i) * time.Minute),
+		}
+		jobLog.Jobs = append(jobLog.Jobs, job)
+	}
+	jobLog.reindex()
+	return jobLog
+}
+
+func jobIDs(jobs []*Job) string {
+	ids := ""
+	for _, job := range jobs {
+		ids += job.ID
+	}
+	return ids
+}
+
+func TestQueryJobs(t *testing.T) {
+	jobLog := testJobLog(8)
+	start := jobLog.Jobs[0].QueuedAt
+	tests := []struct {
+		name  string
+		query *JobQuery
+		want  string
+	}{
+		{"all", &JobQuery{}, "hgfedcba"},
+		{"guest", &JobQuery{GuestID: "g1"}, "geca"},
+		{"status", &JobQuery{Statuses: []JobStatus{"complete"}}, "hfdb"},
+		{"action", &JobQuery{Actions: []string{"stop"}}, "hgdc"},
+		{"actions", &JobQuery{Actions: []string{"stop", "start"}}, "hgfedcba"},
+		{"since", &JobQuery{Since: start.Add(5 * time.Minute)}, "hgf"},
+		{"until", &JobQuery{Until: start.Add(2 * time.Minute)}, "ba"},
+		{"combined", &JobQuery{GuestID: "g2", Actions: []string{"start"}}, "fb"},
+		{"limit", &JobQuery{Limit: 3}, "hgf"},
+		{"cursor", &JobQuery{Cursor: "e"}, "dcba"},
+		{"guest cursor", &JobQuery{GuestID: "g1", Cursor: "e"}, "ca"},
+	}
+	for _, test := range tests {
+		jobs, _, err := jobLog.QueryJobs(test.query)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := jobIDs(jobs); got != test.want {
+			t.Errorf("%s: got jobs %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestQueryJobsPages(t *testing.T) {
+	jobLog := testJobLog(8)
+	query := &JobQuery{GuestID: "g2", Limit: 2}
+	var pages []string
+	for {
+		jobs, next, err := jobLog.QueryJobs(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, jobIDs(jobs))
+		if next == "" {
+			break
+		}
+		if len(pages) > 4 {
+			t.Fatal("too many pages")
+		}
+		query.Cursor = next
+	}
+	want := []string{"hf", "db"}
+	if len(pages) != len(want) {
+		t.Fatalf("got pages %v, want %v", pages, want)
+	}
+	for i := range want {
+		if pages[i] != want[i] {
+			t.Errorf("got pages %v, want %v", pages, want)
+			break
+		}
+	}
+}
+
+func TestQueryJobsExpiredCursor(t *testing.T) {
+	jobLog := testJobLog(3)
+	if _, _, err := jobLog.QueryJobs(&JobQuery{Cursor: "z"}); err != ErrCursorExpired {
+		t.Errorf("got error %v, want %v", err, ErrCursorExpired)
+	}
+}
+
+func TestParseJobQuery(t *testing.T) {
+	params := url.Values{
+		"guest":  {"g1"},
+		"status": {"Complete,Errored", "Running"},
+		"action": {"start"},
+		"since":  {"2016-10-16T00:00:00Z"},
+		"limit":  {"10"},
+	}
+	query, err := parseJobQuery(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.GuestID != "g1" || query.Limit != 10 {
+		t.Errorf("got guest %q and limit %d", query.GuestID, query.Limit)
+	}
+	if len(query.Statuses) != 3 || query.Statuses[2] != Running {
+		t.Errorf("got statuses %v", query.Statuses)
+	}
+	if len(query.Actions) != 1 || query.Actions[0] != "start" {
+		t.Errorf("got actions %v", query.Actions)
+	}
+	if !query.Since.Equal(time.Date(2016, time.October, 16, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got since %s", query.Since)
+	}
+
+	for _, bad := range []url.Values{
+		{"since": {"yesterday"}},
+		{"until": {"2016-10-16"}},
+		{"limit": {"-1"}},
+		{"limit": {"ten"}},
+	} {
+		if _, err := parseJobQuery(bad); err == nil {
+			t.Errorf("parseJobQuery(%v) should fail", bad)
+		}
+	}
+}
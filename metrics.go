@@ -22,18 +22,22 @@ func getMetrics(w http.ResponseWriter, r *http.Request, mtype string) {
 
 	// Metric requests are special in that they have Args that can vary by stage
 	// Create a unique request for each stage with the args
-	// TODO: Fix to use Pre/PostStage functions
 	response := &rpc.GuestMetricsResponse{}
-	pipeline := action.GeneratePipeline(nil, response, hr, nil)
-	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	for _, stage := range pipeline.Stages {
-		stage.Request = &rpc.GuestMetricsRequest{
+	request := &rpc.GuestMetricsRequest{
+		Guest: guest,
+		Type:  mtype,
+	}
+	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	pipeline.PreStageFunc = func(p *Pipeline, s *Stage) error {
+		s.Request = &rpc.GuestMetricsRequest{
 			Guest: guest,
-			Args:  stage.Args,
+			Args:  s.Args,
 			Type:  mtype,
 		}
+		return nil
 	}
-	err = runner.Process(pipeline)
+	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
+	err = runner.Process(r.Context(), pipeline)
 	if err != nil {
 		hr.JSONError(http.StatusInternalServerError, err)
 		return
@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mistifyio/kvite"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/config"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+type (
+	// queuedPipeline is what is saved of a queued async pipeline so it can be
+	// regenerated after a restart
+	queuedPipeline struct {
+		ID       string
+		GuestID  string
+		Action   string
+		Kind     string // The kind of request, which determines how it is rebuilt
+		Priority int
+		Recovers string // ID of the interrupted job, for a recovery
+		QueuedAt time.Time
+		Request  json.RawMessage
+	}
+
+	// queuedByTime sorts saved pipelines by when they were queued
+	queuedByTime []*queuedPipeline
+)
+
+const (
+	queuedBucket = "queued_pipelines"
+
+	queuedGuest    = "guest"
+	queuedSnapshot = "snapshot"
+	queuedImage    = "image"
+)
+
+// requestKind works out the kind of a pipeline's request. Pipelines with
+// requests of other kinds cannot be saved.
+func requestKind(request interface{}) (string, error) {
+	switch request.(type) {
+	case *rpc.GuestRequest:
+		return queuedGuest, nil
+	case *rpc.SnapshotRequest:
+		return queuedSnapshot, nil
+	case *rpc.ImageRequest:
+		return queuedImage, nil
+	default:
+		return "", fmt.Errorf("unable to save queued request of type %T", request)
+	}
+}
+
+// saveQueued saves a queued pipeline along with its request
+func (ctx *Context) saveQueued(guestID string, pipeline *Pipeline) error {
+	kind, err := requestKind(pipeline.request)
+	if err != nil {
+		return err
+	}
+	request, err := json.Marshal(pipeline.request)
+	if err != nil {
+		return err
+	}
+	// A pipeline saved again keeps its place
+	queuedAt := time.Now()
+	if job, err := ctx.JobLog.GetJob(pipeline.ID); err == nil {
+		queuedAt = job.QueuedAt
+	}
+	data, err := json.Marshal(&queuedPipeline{
+		ID:       pipeline.ID,
+		GuestID:  guestID,
+		Action:   pipeline.Action,
+		Kind:     kind,
+		Priority: pipeline.Priority,
+		Recovers: pipeline.recovers,
+		QueuedAt: queuedAt,
+		Request:  request,
+	})
+	if err != nil {
+		return err
+	}
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(queuedBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(pipeline.ID, data)
+	})
+}
+
+// deleteQueued removes a saved pipeline once it is no longer queued
+func (ctx *Context) deleteQueued(id string) error {
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(queuedBucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete(id)
+	})
+}
+
+func (q queuedByTime) Len() int           { return len(q) }
+func (q queuedByTime) Less(i, j int) bool { return q[i].QueuedAt.Before(q[j].QueuedAt) }
+func (q queuedByTime) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+// loadQueued retrieves the saved pipelines in the order they were queued
+func (ctx *Context) loadQueued() ([]*queuedPipeline, error) {
+	var queued []*queuedPipeline
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(queuedBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k string, v []byte) error {
+			var q queuedPipeline
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			queued = append(queued, &q)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(queuedByTime(queued))
+	return queued, nil
+}
+
+// restoreQueued deals with the pipelines that were still queued when the
+// agent stopped. Depending on the config, they are either queued again in
+// their original order or their jobs are failed. A pipeline that can no longer
+// be regenerated, such as one for a guest that is gone, is always failed. A
+// pipeline whose job had already started is left to recovery and only removed,
+// and one already queued again, such as a recovery queued since the restart, is
+// left as it is. Must be called once the guest runners exist.
+func (ctx *Context) restoreQueued() error {
+	queued, err := ctx.loadQueued()
+	if err != nil {
+		return err
+	}
+	for _, q := range queued {
+		if job, err := ctx.JobLog.GetJob(q.ID); err == nil && job.Status != Queued {
+			if err := ctx.deleteQueued(q.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if runner, err := ctx.GetGuestRunner(q.GuestID); err == nil && runner.Async.contains(q.ID) {
+			continue
+		}
+
+		err := fmt.Errorf("agent restarted before the job ran")
+		if ctx.Config.QueuedOnRestart == config.ResumeQueued {
+			err = ctx.requeue(q)
+		}
+		if err == nil {
+			LogRunnerInfo(q.GuestID, "async", q.ID, "Restored")
+			continue
+		}
+
+		LogRunnerError(q.GuestID, "async", q.ID, err.Error())
+		if err := ctx.JobLog.UpdateJob(q.ID, q.Action, Errored, err.Error()); err != nil && err != ErrNotFound {
+			return err
+		}
+		if err := ctx.deleteQueued(q.ID); err != nil {
+			return err
+		}
+		ctx.deliverCallbacks(q.GuestID, q.ID)
+	}
+	return nil
+}
+
+// requeue regenerates a saved pipeline and queues it again for its guest
+func (ctx *Context) requeue(q *queuedPipeline) error {
+	runner, err := ctx.GetGuestRunner(q.GuestID)
+	if err != nil {
+		return err
+	}
+	action, err := ctx.GetAction(q.Action)
+	if err != nil {
+		return err
+	}
+
+	var pipeline *Pipeline
+	switch {
+	case q.Recovers != "":
+		// A recovery may be made of only some of its action's stages, so it
+		// is worked out again from the interrupted job
+		var job *Job
+		if job, err = ctx.JobLog.GetJob(q.Recovers); err != nil {
+			return err
+		}
+		if pipeline, err = ctx.recoveryPipeline(job); err != nil {
+			return err
+		}
+		if pipeline == nil {
+			return fmt.Errorf("nothing left to recover for job %s", q.Recovers)
+		}
+	case q.Kind == queuedGuest:
+		// The guest may have changed since the action was queued
+		var g *client.Guest
+		if g, err = ctx.GetGuest(q.GuestID); err != nil {
+			return err
+		}
+		done := make(chan error)
+		pipeline, _ = ctx.newGuestPipeline(action, g, nil, done)
+		go ctx.afterGuestAction(g, action.Name, done)
+	case q.Kind == queuedSnapshot:
+		request := &rpc.SnapshotRequest{}
+		if err = json.Unmarshal(q.Request, request); err != nil {
+			return err
+		}
+		pipeline = action.GeneratePipeline(request, &rpc.SnapshotResponse{}, nil, nil)
+	case q.Kind == queuedImage:
+		request := &rpc.ImageRequest{}
+		if err = json.Unmarshal(q.Request, request); err != nil {
+			return err
+		}
+		pipeline = action.GeneratePipeline(request, &rpc.ImageResponse{}, nil, nil)
+	default:
+		return fmt.Errorf("unknown queued request kind %s", q.Kind)
+	}
+	pipeline.ID = q.ID
+	pipeline.Priority = q.Priority
+	pipeline.recovers = q.Recovers
+
+	runner.Async.restore(pipeline)
+	return nil
+}
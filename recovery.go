@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"github.com/mistifyio/mistify-agent/config"
+)
+
+// recoverInterrupted marks the jobs that were running when the agent stopped
+// as interrupted. For those with a recovery configured for their action, the
+// recovery is queued as a new job at the front of the guest's queue, so it
+// runs before any other work for the guest. Must be called once the guest
+// runners exist and before any queued actions are restored.
+func (ctx *Context) recoverInterrupted() error {
+	for _, job := range ctx.JobLog.getJobsByStatus(Running) {
+		if err := ctx.JobLog.UpdateJob(job.ID, job.Action, Interrupted, "interrupted by an agent restart"); err != nil {
+			return err
+		}
+		LogRunnerInfo(job.GuestID, "async", job.ID, "Interrupted")
+
+		pipeline, err := ctx.recoveryPipeline(job)
+		if err != nil {
+			LogRunnerError(job.GuestID, "async", job.ID, "unable to recover: "+err.Error())
+			continue
+		}
+		if pipeline == nil {
+			continue
+		}
+		runner, err := ctx.GetGuestRunner(job.GuestID)
+		if err != nil {
+			LogRunnerError(job.GuestID, "async", job.ID, "unable to recover: "+err.Error())
+			continue
+		}
+
+		runner.Async.enqueueRecovery(pipeline, job.ID)
+		if err := ctx.JobLog.SetRecovery(job.ID, pipeline.ID); err != nil {
+			return err
+		}
+		LogRunnerInfo(job.GuestID, "async", pipeline.ID, "Recovering "+job.ID)
+	}
+	return nil
+}
+
+// recoveryPipeline generates the pipeline that recovers from a job being
+// interrupted, if its action has a recovery. Only guest actions can be
+// recovered.
+func (ctx *Context) recoveryPipeline(job *Job) (*Pipeline, error) {
+	action, err := ctx.GetAction(job.Action)
+	if err != nil || action.Recovery == "" {
+		return nil, err
+	}
+	g, err := ctx.GetGuest(job.GuestID)
+	if err != nil {
+		return nil, err
+	}
+
+	if action.Recovery != config.CompensateRecovery {
+		recovery, err := ctx.GetAction(action.Recovery)
+		if err != nil {
+			return nil, err
+		}
+		pipeline, _ := ctx.newGuestPipeline(recovery, g, nil, nil)
+		return pipeline, nil
+	}
+
+	compensations := action.compensations(job)
+	if len(compensations) == 0 {
+		return nil, nil
+	}
+	pipeline, response := ctx.newGuestPipeline(action, g, nil, nil)
+	pipeline.Stages = make([]*Stage, len(compensations))
+	for i, stage := range compensations {
+		pipeline.Stages[i] = stage.instance(pipeline, pipeline.request, response, nil)
+	}
+	// The action's hooks already ran when the job started
+	pipeline.before, pipeline.success, pipeline.failure = nil, nil, nil
+	return pipeline, nil
+}
+
+// compensations returns the compensating stages for the stages an interrupted
+// job completed, in the order they should run. Stages already compensated
+// before the interruption are left out. The stage that was running is not
+// known to have done anything, so it is not compensated.
+func (action *Action) compensations(job *Job) []*Stage {
+	// Stages by index, then by position in their parallel group
+	completed := make(map[int]map[int]bool)
+	compensated := make(map[int]map[int]bool)
+	mark := func(stages map[int]map[int]bool, index, member int) {
+		if stages[index] == nil {
+			stages[index] = make(map[int]bool)
+		}
+		stages[index][member] = true
+	}
+	for _, progress := range job.Stages {
+		if progress.Status == Complete {
+			mark(completed, progress.Index, progress.Member)
+		}
+	}
+	for _, rollback := range job.Rollbacks {
+		if rollback.Error == "" {
+			mark(compensated, rollback.Index, rollback.Member)
+		}
+	}
+
+	var stages []*Stage
+	for i := len(action.Stages) - 1; i >= 0; i-- {
+		if len(action.Stages[i].Parallel) == 0 {
+			stage := action.Stages[i]
+			if stage.Compensate != nil && completed[i][-1] && !compensated[i][-1] {
+				stages = append(stages, stage.Compensate)
+			}
+			continue
+		}
+		members := action.Stages[i].Parallel
+		for j := len(members) - 1; j >= 0; j-- {
+			stage := members[j]
+			if stage.Compensate != nil && completed[i][j] && !compensated[i][j] {
+				stages = append(stages, stage.Compensate)
+			}
+		}
+	}
+	return stages
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"testing"
+)
+
+func TestCompensations(t *testing.T) {
+	// Every stage calls the same method, so only their positions tell them
+	// apart
+	stage := func(name string) *Stage {
+		return &Stage{Method: "Disk.Create", Compensate: &Stage{Name: name, Method: "Disk.Delete"}}
+	}
+	action := &Action{
+		Stages: []*Stage{
+			stage("undo0"),
+			{Parallel: []*Stage{stage("undo1.0"), stage("undo1.1"), {Method: "Disk.Create"}}},
+			stage("undo2"),
+		},
+	}
+	complete := func(index, member int) *StageProgress {
+		return &StageProgress{Index: index, Member: member, Method: "Disk.Create", Status: Complete}
+	}
+
+	tests := []struct {
+		name string
+		job  *Job
+		want []string
+	}{
+		{
+			"none completed",
+			&Job{},
+			nil,
+		},
+		{
+			"all completed",
+			&Job{Stages: []*StageProgress{complete(0, -1), complete(1, 0), complete(1, 1), complete(1, 2), complete(2, -1)}},
+			[]string{"undo2", "undo1.1", "undo1.0", "undo0"},
+		},
+		{
+			"one group member completed",
+			&Job{Stages: []*StageProgress{complete(0, -1), complete(1, 1)}},
+			[]string{"undo1.1", "undo0"},
+		},
+		{
+			"running stage left alone",
+			&Job{Stages: []*StageProgress{
+				complete(0, -1),
+				{Index: 1, Member: 0, Method: "Disk.Create", Status: Running},
+			}},
+			[]string{"undo0"},
+		},
+		{
+			"already compensated",
+			&Job{
+				Stages: []*StageProgress{complete(0, -1), complete(1, 0), complete(1, 1)},
+				Rollbacks: []*StageRollback{
+					{Stage: "Disk.Create", Index: 1, Member: 1, Method: "Disk.Delete"},
+				},
+			},
+			[]string{"undo1.0", "undo0"},
+		},
+		{
+			"failed compensation run again",
+			&Job{
+				Stages: []*StageProgress{complete(0, -1)},
+				Rollbacks: []*StageRollback{
+					{Stage: "Disk.Create", Index: 0, Member: -1, Method: "Disk.Delete", Error: "failed"},
+				},
+			},
+			[]string{"undo0"},
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, compensation := range action.compensations(test.job) {
+			got = append(got, compensation.Name)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got compensations %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got compensations %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
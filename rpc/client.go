@@ -2,11 +2,12 @@ package rpc
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	rpcJSON "github.com/gorilla/rpc/json"
 	logx "github.com/mistifyio/mistify-logrus-ext"
@@ -15,10 +16,32 @@ import (
 type (
 	// Client is a simple JSON-RPC over HTTP client used by the agent.
 	Client struct {
-		URL string
+		URL     string
+		Timeout time.Duration // Limit for a single call. Zero means no limit
+	}
+
+	// TransportError is returned when a sub-agent could not be reached or
+	// the connection failed before a response was received
+	TransportError struct {
+		Err error
+	}
+
+	// StatusError is returned when a sub-agent responds with an HTTP error
+	// status
+	StatusError struct {
+		Code    int
+		Message string
 	}
 )
 
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
 // NewClient create a new client.  This only communicates with 127.0.0.1
 func NewClient(port uint, path string) (*Client, error) {
 	if path == "" {
@@ -33,26 +56,43 @@ func NewClient(port uint, path string) (*Client, error) {
 
 // Do calls an RPC method
 func (c *Client) Do(method string, request interface{}, response interface{}) error {
+	return c.DoContext(context.Background(), method, request, response)
+}
+
+// DoContext calls an RPC method, giving up when the context is done or the
+// client timeout passes. In that case the context's error is returned.
+func (c *Client) DoContext(ctx context.Context, method string, request interface{}, response interface{}) error {
 	data, err := rpcJSON.EncodeClientRequest(method, request)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(c.URL, "application/json", bytes.NewReader(data))
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	resp, err := c.post(ctx, data)
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &TransportError{err}
 	}
 	defer logx.LogReturnedErr(resp.Body.Close, nil, "failed to close response body")
 
 	if resp.StatusCode >= http.StatusBadRequest {
 		var buf bytes.Buffer
 		if _, err = buf.ReadFrom(resp.Body); err != nil {
-			return err
+			return &TransportError{err}
 		}
-		return errors.New(buf.String())
+		return &StatusError{resp.StatusCode, buf.String()}
 	}
 
 	err = rpcJSON.DecodeClientResponse(resp.Body, &response)
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 	return nil
@@ -60,12 +100,24 @@ func (c *Client) Do(method string, request interface{}, response interface{}) er
 
 // DoRaw calls a service and proxies the response
 func (c *Client) DoRaw(request interface{}, rw http.ResponseWriter) {
+	c.DoRawContext(context.Background(), request, rw)
+}
+
+// DoRawContext calls a service and proxies the response, giving up when the
+// context is done or the client timeout passes. The timeout covers the whole
+// transfer of the response.
+func (c *Client) DoRawContext(ctx context.Context, request interface{}, rw http.ResponseWriter) {
 	data, err := json.Marshal(request)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	resp, err := http.Post(c.URL, "application/json", bytes.NewReader(data))
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	resp, err := c.post(ctx, data)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
@@ -88,3 +140,13 @@ func (c *Client) DoRaw(request interface{}, rw http.ResponseWriter) {
 	}
 	return
 }
+
+// post sends a JSON request body to the service
+func (c *Client) post(ctx context.Context, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
@@ -16,7 +16,7 @@ type (
 	GuestResponse struct {
 		Guest   *client.Guest `json:"guest"`             // Guest, possibly modified
 		Message string        `json:"message,omitempty"` // Any informational message
-		Retry   int           `json:"retry,omitempty"`   // instruct the agent to retry after this many second. Not yet implemented
+		Retry   int           `json:"retry,omitempty"`   // instruct the agent to retry after this many seconds
 	}
 
 	// GuestMetricsRequest is a request for guest metrics
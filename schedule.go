@@ -0,0 +1,443 @@
+package agent
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mistifyio/kvite"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/config"
+	"github.com/pborman/uuid"
+)
+
+type (
+	// Schedule runs a guest action at a set time, or repeatedly on a cron
+	// schedule. Exactly one of At and Cron is set.
+	Schedule struct {
+		ID        string
+		GuestID   string
+		Action    string     // Guest action, such as "restart"
+		At        *time.Time `json:",omitempty"` // When to run the action once
+		Cron      string     `json:",omitempty"` // When to run the action repeatedly
+		Disabled  bool
+		CreatedAt time.Time
+		NextRun   time.Time // Zero once there are no more runs
+		LastRun   time.Time
+		LastJob   string // ID of the job started by the last run
+		LastError string // Why the last run failed to start a job, if it did
+	}
+
+	// schedulesByNextRun sorts schedules by when they next run
+	schedulesByNextRun []*Schedule
+)
+
+const scheduleBucket = "schedules"
+
+// schedulerMaxWait is the longest the scheduler sleeps between checks for due
+// schedules
+const schedulerMaxWait = time.Minute
+
+// guestAction looks up the action a schedule runs for a guest. Only async
+// actions may be scheduled.
+func (ctx *Context) guestAction(g *client.Guest, name string) (*Action, error) {
+	action, err := ctx.GetAction(prefixedActionName(g.Type, name))
+	if err != nil {
+		return nil, err
+	}
+	if action.Type != config.AsyncAction {
+		return nil, fmt.Errorf("%s: only async actions can be scheduled", action.Name)
+	}
+	return action, nil
+}
+
+// next works out when a schedule should next run after the given time. A
+// one-off schedule runs at its time, even if that has already passed, and only
+// until it has run once.
+func (s *Schedule) next(after time.Time) (time.Time, error) {
+	if s.Cron != "" {
+		c, err := parseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return c.next(after), nil
+	}
+	if s.At == nil || !s.LastRun.IsZero() {
+		return time.Time{}, nil
+	}
+	return *s.At, nil
+}
+
+// validateSchedule checks a schedule's guest, action, and timing, and works out
+// when it next runs
+func (ctx *Context) validateSchedule(s *Schedule) error {
+	if (s.At == nil) == (s.Cron == "") {
+		return errors.New("exactly one of at and cron must be set")
+	}
+	g, err := ctx.GetGuest(s.GuestID)
+	if err != nil {
+		return fmt.Errorf("guest %s: %s", s.GuestID, err)
+	}
+	if _, err := ctx.guestAction(g, s.Action); err != nil {
+		return err
+	}
+	if s.NextRun, err = s.next(time.Now()); err != nil {
+		return err
+	}
+	if s.Cron != "" && s.NextRun.IsZero() {
+		return fmt.Errorf("cron spec %q never matches", s.Cron)
+	}
+	return nil
+}
+
+// GetSchedule fetches a single schedule
+func (ctx *Context) GetSchedule(id string) (*Schedule, error) {
+	var s Schedule
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(scheduleBucket)
+		if err != nil {
+			return err
+		}
+		data, err := b.Get(id)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s schedulesByNextRun) Len() int           { return len(s) }
+func (s schedulesByNextRun) Less(i, j int) bool { return s[i].NextRun.Before(s[j].NextRun) }
+func (s schedulesByNextRun) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ListSchedules fetches all schedules, or only those for a guest, ordered by
+// when they next run
+func (ctx *Context) ListSchedules(guestID string) ([]*Schedule, error) {
+	schedules := make([]*Schedule, 0)
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(scheduleBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k string, v []byte) error {
+			var s Schedule
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if guestID == "" || s.GuestID == guestID {
+				schedules = append(schedules, &s)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(schedulesByNextRun(schedules))
+	return schedules, nil
+}
+
+// PersistSchedule writes a schedule to the data store and lets the scheduler
+// know it has changed
+func (ctx *Context) PersistSchedule(s *Schedule) error {
+	if err := ctx.persistSchedule(s); err != nil {
+		return err
+	}
+	ctx.wakeScheduler()
+	return nil
+}
+
+// persistSchedule writes a schedule to the data store
+func (ctx *Context) persistSchedule(s *Schedule) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(scheduleBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(s.ID, data)
+	})
+}
+
+// DeleteSchedule removes a schedule from the data store
+func (ctx *Context) DeleteSchedule(id string) error {
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(scheduleBucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete(id)
+	})
+}
+
+// deleteGuestSchedules removes the schedules of a deleted guest
+func (ctx *Context) deleteGuestSchedules(guestID string) error {
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	schedules, err := ctx.ListSchedules(guestID)
+	if err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		if err := ctx.DeleteSchedule(s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wakeScheduler has the scheduler check for due schedules straight away
+func (ctx *Context) wakeScheduler() {
+	select {
+	case ctx.scheduleChan <- struct{}{}:
+	default:
+	}
+}
+
+// runScheduler queues the actions of due schedules and snapshot policies. It
+// sleeps until the next one is due, checking at least once every
+// schedulerMaxWait and whenever a schedule or snapshot policy changes.
+func (ctx *Context) runScheduler() {
+	for {
+		now := time.Now()
+		next, err := ctx.runDueSchedules(now)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"func":  "agent.Context.runDueSchedules",
+			}).Error("failed to run schedules")
+		}
+		nextPolicy, err := ctx.runDueSnapshotPolicies(now)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"func":  "agent.Context.runDueSnapshotPolicies",
+			}).Error("failed to run snapshot policies")
+		}
+		if next.IsZero() || (!nextPolicy.IsZero() && nextPolicy.Before(next)) {
+			next = nextPolicy
+		}
+
+		wait := schedulerMaxWait
+		if !next.IsZero() {
+			if until := next.Sub(time.Now()); until < wait {
+				wait = until
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.scheduleChan:
+		}
+	}
+}
+
+// runDueSchedules runs every enabled schedule that is due and returns when the
+// next one is due
+func (ctx *Context) runDueSchedules(now time.Time) (time.Time, error) {
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	schedules, err := ctx.ListSchedules("")
+	if err != nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	for _, s := range schedules {
+		if s.Disabled || s.NextRun.IsZero() {
+			continue
+		}
+		if s.NextRun.After(now) {
+			if next.IsZero() || s.NextRun.Before(next) {
+				next = s.NextRun
+			}
+			continue
+		}
+
+		s.LastRun = now
+		s.LastError = ""
+		if s.LastJob, err = ctx.runSchedule(s); err != nil {
+			s.LastError = err.Error()
+			LogRunnerError(s.GuestID, "schedule", s.ID, err.Error())
+		}
+		if s.NextRun, err = s.next(now); err != nil {
+			s.LastError = err.Error()
+		}
+		if err := ctx.persistSchedule(s); err != nil {
+			return time.Time{}, err
+		}
+		if !s.NextRun.IsZero() && (next.IsZero() || s.NextRun.Before(next)) {
+			next = s.NextRun
+		}
+	}
+	return next, nil
+}
+
+// runSchedule queues a schedule's action for its guest and links the job to the
+// schedule. It returns the ID of the job, which is an existing one if the
+// action was coalesced.
+func (ctx *Context) runSchedule(s *Schedule) (string, error) {
+	g, err := ctx.GetGuest(s.GuestID)
+	if err != nil {
+		return "", err
+	}
+	runner, err := ctx.GetGuestRunner(g.ID)
+	if err != nil {
+		return "", err
+	}
+	action, err := ctx.guestAction(g, s.Action)
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error)
+	pipeline, _ := ctx.newGuestPipeline(action, g, nil, done)
+	id := pipeline.ID
+	if err := runner.Process(stdcontext.Background(), pipeline); err != nil {
+		return "", err
+	}
+	go ctx.afterGuestAction(g, action.Name, done)
+	LogRunnerInfo(g.ID, "schedule", pipeline.ID, "Queued by schedule "+s.ID)
+	if pipeline.ID == id {
+		if err := ctx.JobLog.SetSchedule(pipeline.ID, s.ID); err != nil {
+			LogRunnerError(g.ID, "schedule", pipeline.ID, err.Error())
+		}
+	}
+	return pipeline.ID, nil
+}
+
+// getRequestSchedule looks up the schedule for a request, writing an error
+// response if it cannot be found
+func getRequestSchedule(hr *HTTPResponse, r *http.Request) *Schedule {
+	ctx := getContext(r)
+	vars := mux.Vars(r)
+
+	s, err := ctx.GetSchedule(vars["scheduleID"])
+	if err != nil {
+		code := http.StatusInternalServerError
+		if err == ErrNotFound {
+			code = http.StatusNotFound
+		}
+		hr.JSONError(code, err)
+		return nil
+	}
+	return s
+}
+
+func listSchedules(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	schedules, err := ctx.ListSchedules(r.URL.Query().Get("guest"))
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusOK, schedules)
+}
+
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	s := &Schedule{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	s.ID = uuid.New()
+	s.CreatedAt = time.Now()
+	s.LastRun, s.LastJob, s.LastError = time.Time{}, "", ""
+
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	if err := ctx.validateSchedule(s); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	if err := ctx.PersistSchedule(s); err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusCreated, s)
+}
+
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	if s := getRequestSchedule(hr, r); s != nil {
+		hr.JSON(http.StatusOK, s)
+	}
+}
+
+// updateSchedule changes the action, timing, or disabled state of a schedule.
+// Fields not in the request are left as they were, and at may be set to null to
+// switch a schedule to cron.
+func updateSchedule(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	s := getRequestSchedule(hr, r)
+	if s == nil {
+		return
+	}
+	updated := *s
+	if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	// Only the action, timing, and disabled state may be changed
+	updated.ID, updated.GuestID, updated.CreatedAt = s.ID, s.GuestID, s.CreatedAt
+	updated.LastRun, updated.LastJob, updated.LastError = s.LastRun, s.LastJob, s.LastError
+	if updated.At != nil && (s.At == nil || !updated.At.Equal(*s.At)) {
+		// A new one-off time runs again
+		updated.LastRun = time.Time{}
+	}
+
+	if err := ctx.validateSchedule(&updated); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	if err := ctx.PersistSchedule(&updated); err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusOK, &updated)
+}
+
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	s := getRequestSchedule(hr, r)
+	if s == nil {
+		return
+	}
+	if err := ctx.DeleteSchedule(s.ID); err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusOK, s)
+}
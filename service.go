@@ -1,6 +1,12 @@
 package agent
 
-import "github.com/mistifyio/mistify-agent/rpc"
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mistifyio/mistify-agent/rpc"
+)
 
 type (
 	// Service is an RPC service
@@ -9,14 +15,27 @@ type (
 		Client *rpc.Client
 		Name   string
 	}
+
+	// ServiceInfo describes a configured service
+	ServiceInfo struct {
+		Name       string
+		Port       uint
+		Path       string
+		MaxPending uint
+		Timeout    uint // Seconds allowed for a single call
+	}
+
+	// servicesByName sorts services by name
+	servicesByName []*ServiceInfo
 )
 
 // NewService creates a new Service
-func (ctx *Context) NewService(name string, port uint, path string, maxConcurrent uint) (*Service, error) {
+func (ctx *Context) NewService(name string, port uint, path string, maxConcurrent uint, timeout time.Duration) (*Service, error) {
 	c, err := rpc.NewClient(port, path)
 	if err != nil {
 		return nil, err
 	}
+	c.Timeout = timeout
 	s := &Service{
 		ctx:    ctx,
 		Client: c,
@@ -25,3 +44,25 @@ func (ctx *Context) NewService(name string, port uint, path string, maxConcurren
 
 	return s, err
 }
+
+func (s servicesByName) Len() int           { return len(s) }
+func (s servicesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s servicesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func listServices(w http.ResponseWriter, r *http.Request) {
+	hr := HTTPResponse{w}
+	ctx := getContext(r)
+
+	services := make([]*ServiceInfo, 0, len(ctx.Config.Services))
+	for name, service := range ctx.Config.Services {
+		services = append(services, &ServiceInfo{
+			Name:       name,
+			Port:       service.Port,
+			Path:       service.Path,
+			MaxPending: service.MaxPending,
+			Timeout:    service.Timeout,
+		})
+	}
+	sort.Sort(servicesByName(services))
+	hr.JSON(http.StatusOK, services)
+}
@@ -12,6 +12,9 @@ import (
 )
 
 func getHTTPErrorCode(err error) int {
+	if _, ok := err.(*StageTimeoutError); ok {
+		return http.StatusGatewayTimeout
+	}
 	if err.Error() == ErrNotFound.Error() {
 		return http.StatusNotFound
 	}
@@ -45,8 +48,8 @@ func listSnapshots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	err = runner.Process(r.Context(), pipeline)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
 	if err != nil {
 		hr.JSONError(getHTTPErrorCode(err), err)
 		return
@@ -67,8 +70,8 @@ func getSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	err = runner.Process(r.Context(), pipeline)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
 	if err != nil {
 		hr.JSONError(getHTTPErrorCode(err), err)
 		return
@@ -101,10 +104,14 @@ func createSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	if isDryRun(r) {
+		hr.JSON(http.StatusOK, pipeline.Plan())
+		return
+	}
+	err = runner.Process(r.Context(), pipeline)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
 	if err != nil {
-		hr.JSONError(getHTTPErrorCode(err), err)
+		hr.processError(getHTTPErrorCode(err), err)
 		return
 	}
 	hr.JSON(http.StatusOK, response.Snapshots)
@@ -129,10 +136,14 @@ func deleteSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	if isDryRun(r) {
+		hr.JSON(http.StatusOK, pipeline.Plan())
+		return
+	}
+	err = runner.Process(r.Context(), pipeline)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
 	if err != nil {
-		hr.JSONError(getHTTPErrorCode(err), err)
+		hr.processError(getHTTPErrorCode(err), err)
 		return
 	}
 	hr.JSON(http.StatusOK, response.Snapshots)
@@ -158,10 +169,14 @@ func rollbackSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
+	if isDryRun(r) {
+		hr.JSON(http.StatusOK, pipeline.Plan())
+		return
+	}
+	err = runner.Process(r.Context(), pipeline)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
-	err = runner.Process(pipeline)
 	if err != nil {
-		hr.JSONError(getHTTPErrorCode(err), err)
+		hr.processError(getHTTPErrorCode(err), err)
 		return
 	}
 
@@ -189,7 +204,7 @@ func downloadSnapshot(w http.ResponseWriter, r *http.Request) {
 	pipeline := action.GeneratePipeline(request, response, hr, nil)
 	hr.Header().Set("X-Guest-Job-ID", pipeline.ID)
 	// Streaming handles sending its own error responses
-	_ = runner.Process(pipeline)
+	_ = runner.Process(r.Context(), pipeline)
 
 	return
 }
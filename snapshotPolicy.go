@@ -0,0 +1,404 @@
+package agent
+
+import (
+	stdcontext "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mistifyio/kvite"
+	"github.com/mistifyio/mistify-agent/client"
+	"github.com/mistifyio/mistify-agent/rpc"
+)
+
+type (
+	// SnapshotPolicy takes snapshots of all of a guest's disks on a schedule
+	// and keeps only the most recent ones. Snapshots are named after the
+	// policy, such as hourly-1476652800.
+	SnapshotPolicy struct {
+		Name      string // Such as "hourly", which also sets a default Cron
+		Cron      string // When to take snapshots
+		Keep      int    // How many of the policy's snapshots to keep
+		NextRun   time.Time
+		LastRun   time.Time
+		LastJob   string // ID of the createSnapshot job started by the last run
+		LastError string // Why the last run failed to start a job, if it did
+	}
+
+	// snapshotsByTime sorts a policy's snapshot names by when they were taken
+	snapshotsByTime struct {
+		names []string
+		taken map[string]int64
+	}
+)
+
+const (
+	snapshotPolicyBucket = "snapshot_policies"
+
+	// SnapshotPoliciesMetadataKey is the guest metadata key that may be used
+	// to set snapshot policies, as a list of names and how many to keep, such
+	// as "hourly:24,daily:7". Only names with a default cron spec may be used.
+	// The policies replace the guest's existing ones, and the key itself is not
+	// kept in the metadata.
+	SnapshotPoliciesMetadataKey = "snapshot_policies"
+)
+
+var (
+	// snapshotPolicyCrons are the default cron specs for policy names
+	snapshotPolicyCrons = map[string]string{
+		"hourly":  "@hourly",
+		"daily":   "@daily",
+		"weekly":  "@weekly",
+		"monthly": "@monthly",
+	}
+
+	snapshotPolicyName = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+)
+
+// validate checks a policy, filling in its default cron spec
+func (p *SnapshotPolicy) validate() error {
+	if !snapshotPolicyName.MatchString(p.Name) {
+		return fmt.Errorf("snapshot policy name %q may only contain letters, digits, and underscores", p.Name)
+	}
+	if p.Name == "snap" {
+		return fmt.Errorf("snapshot policy name %q is reserved for snapshots taken on request", p.Name)
+	}
+	if p.Keep < 1 {
+		return fmt.Errorf("snapshot policy %s must keep at least 1 snapshot", p.Name)
+	}
+	if p.Cron == "" {
+		p.Cron = snapshotPolicyCrons[p.Name]
+	}
+	if p.Cron == "" {
+		return fmt.Errorf("snapshot policy %s needs a cron spec", p.Name)
+	}
+	c, err := parseCron(p.Cron)
+	if err != nil {
+		return fmt.Errorf("snapshot policy %s: %s", p.Name, err)
+	}
+	if c.next(time.Now()).IsZero() {
+		return fmt.Errorf("snapshot policy %s: cron spec %q never matches", p.Name, p.Cron)
+	}
+	return nil
+}
+
+// validateSnapshotPolicies checks a guest's policies, which must have unique
+// names
+func validateSnapshotPolicies(policies []*SnapshotPolicy) error {
+	names := make(map[string]bool)
+	for _, p := range policies {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("snapshot policy %s is defined more than once", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+// parseSnapshotPolicies parses and validates snapshot policies from guest
+// metadata
+func parseSnapshotPolicies(value string) ([]*SnapshotPolicy, error) {
+	var policies []*SnapshotPolicy
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid %s %q, expected name:keep", SnapshotPoliciesMetadataKey, part)
+		}
+		keep, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", SnapshotPoliciesMetadataKey, part, err)
+		}
+		name := fields[0]
+		if _, ok := snapshotPolicyCrons[name]; !ok {
+			return nil, fmt.Errorf("invalid %s %q: unknown interval %s", SnapshotPoliciesMetadataKey, part, name)
+		}
+		policies = append(policies, &SnapshotPolicy{Name: name, Keep: keep})
+	}
+	if err := validateSnapshotPolicies(policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// GetSnapshotPolicies fetches the snapshot policies for a guest
+func (ctx *Context) GetSnapshotPolicies(guestID string) ([]*SnapshotPolicy, error) {
+	policies := make([]*SnapshotPolicy, 0)
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(snapshotPolicyBucket)
+		if err != nil {
+			return err
+		}
+		data, err := b.Get(guestID)
+		if err != nil || data == nil {
+			return err
+		}
+		return json.Unmarshal(data, &policies)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// SetSnapshotPolicies replaces the snapshot policies for a guest. The policies
+// must already have been validated. The run history of a policy is kept if a
+// policy with the same name already exists.
+func (ctx *Context) SetSnapshotPolicies(guestID string, policies []*SnapshotPolicy) error {
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	existing, err := ctx.GetSnapshotPolicies(guestID)
+	if err != nil {
+		return err
+	}
+	old := make(map[string]*SnapshotPolicy)
+	for _, p := range existing {
+		old[p.Name] = p
+	}
+	now := time.Now()
+	for _, p := range policies {
+		p.LastRun, p.LastJob, p.LastError = time.Time{}, "", ""
+		if o, ok := old[p.Name]; ok {
+			p.LastRun, p.LastJob, p.LastError = o.LastRun, o.LastJob, o.LastError
+		}
+		c, _ := parseCron(p.Cron)
+		p.NextRun = c.next(now)
+	}
+
+	if err := ctx.persistSnapshotPolicies(guestID, policies); err != nil {
+		return err
+	}
+	ctx.wakeScheduler()
+	return nil
+}
+
+// persistSnapshotPolicies writes the snapshot policies for a guest to the data
+// store, removing them if there are none
+func (ctx *Context) persistSnapshotPolicies(guestID string, policies []*SnapshotPolicy) error {
+	data, err := json.Marshal(policies)
+	if err != nil {
+		return err
+	}
+	return ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(snapshotPolicyBucket)
+		if err != nil {
+			return err
+		}
+		if len(policies) == 0 {
+			return b.Delete(guestID)
+		}
+		return b.Put(guestID, data)
+	})
+}
+
+// runDueSnapshotPolicies runs every snapshot policy that is due and returns
+// when the next one is due
+func (ctx *Context) runDueSnapshotPolicies(now time.Time) (time.Time, error) {
+	ctx.scheduleMutex.Lock()
+	defer ctx.scheduleMutex.Unlock()
+
+	all := make(map[string][]*SnapshotPolicy)
+	err := ctx.db.Transaction(func(tx *kvite.Tx) error {
+		b, err := tx.Bucket(snapshotPolicyBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k string, v []byte) error {
+			var policies []*SnapshotPolicy
+			if err := json.Unmarshal(v, &policies); err != nil {
+				return err
+			}
+			all[k] = policies
+			return nil
+		})
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	for guestID, policies := range all {
+		changed := false
+		for _, p := range policies {
+			if !p.NextRun.After(now) {
+				changed = true
+				p.LastRun = now
+				p.LastError = ""
+				if p.LastJob, err = ctx.runSnapshotPolicy(guestID, p); err != nil {
+					p.LastError = err.Error()
+					LogRunnerError(guestID, "snapshot policy", p.Name, err.Error())
+				}
+				if c, err := parseCron(p.Cron); err == nil {
+					p.NextRun = c.next(now)
+				}
+			}
+			if !p.NextRun.IsZero() && (next.IsZero() || p.NextRun.Before(next)) {
+				next = p.NextRun
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := ctx.persistSnapshotPolicies(guestID, policies); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return next, nil
+}
+
+// runSnapshotPolicy queues a snapshot of all of a guest's disks for a policy,
+// along with the deletion of the policy's oldest earlier snapshots beyond the
+// number it keeps. Pruning on every run, rather than once a snapshot is taken,
+// means snapshots are still pruned if a run was interrupted. It returns the ID
+// of the createSnapshot job.
+func (ctx *Context) runSnapshotPolicy(guestID string, p *SnapshotPolicy) (string, error) {
+	g, err := ctx.GetGuest(guestID)
+	if err != nil {
+		return "", err
+	}
+	runner, err := ctx.GetGuestRunner(g.ID)
+	if err != nil {
+		return "", err
+	}
+	action, err := ctx.GetAction("createSnapshot")
+	if err != nil {
+		return "", err
+	}
+
+	request := &rpc.SnapshotRequest{
+		ID:        "guests/" + g.ID,
+		Dest:      fmt.Sprintf("%s-%d", p.Name, time.Now().Unix()),
+		Recursive: true,
+	}
+	pipeline := action.GeneratePipeline(request, &rpc.SnapshotResponse{}, nil, nil)
+	if err := runner.Process(stdcontext.Background(), pipeline); err != nil {
+		return "", err
+	}
+	if err := ctx.JobLog.SetSnapshotPolicy(pipeline.ID, p.Name); err != nil {
+		LogRunnerError(g.ID, "snapshot policy", pipeline.ID, err.Error())
+	}
+
+	policy := *p
+	go func() {
+		if err := ctx.pruneSnapshots(g, runner, &policy, request.Dest); err != nil {
+			LogRunnerError(g.ID, "snapshot policy", policy.Name, err.Error())
+		}
+	}()
+	return pipeline.ID, nil
+}
+
+// pruneSnapshots queues the deletion of a policy's snapshots of a guest beyond
+// the number it keeps, oldest first. The snapshot being taken is not counted.
+func (ctx *Context) pruneSnapshots(g *client.Guest, runner *GuestRunner, p *SnapshotPolicy, taking string) error {
+	list, err := ctx.GetAction("listSnapshots")
+	if err != nil {
+		return err
+	}
+	response := &rpc.SnapshotResponse{}
+	pipeline := list.GeneratePipeline(&rpc.SnapshotRequest{ID: "guests/" + g.ID}, response, nil, nil)
+	if err := runner.Process(stdcontext.Background(), pipeline); err != nil {
+		return err
+	}
+
+	// Snapshots of each disk share a name, which ends in when it was taken
+	taken := make(map[string]int64)
+	prefix := p.Name + "-"
+	for _, snapshot := range response.Snapshots {
+		i := strings.LastIndex(snapshot.ID, "@")
+		if i < 0 || !strings.HasPrefix(snapshot.ID[i+1:], prefix) {
+			continue
+		}
+		name := snapshot.ID[i+1:]
+		if name == taking {
+			continue
+		}
+		if unix, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64); err == nil {
+			taken[name] = unix
+		}
+	}
+	if len(taken) <= p.Keep {
+		return nil
+	}
+	names := make([]string, 0, len(taken))
+	for name := range taken {
+		names = append(names, name)
+	}
+	sort.Sort(snapshotsByTime{names: names, taken: taken})
+
+	action, err := ctx.GetAction("deleteSnapshot")
+	if err != nil {
+		return err
+	}
+	for _, name := range names[:len(names)-p.Keep] {
+		request := &rpc.SnapshotRequest{
+			ID:        "guests/" + g.ID + "@" + name,
+			Recursive: true,
+		}
+		pipeline := action.GeneratePipeline(request, &rpc.SnapshotResponse{}, nil, nil)
+		if err := runner.Process(stdcontext.Background(), pipeline); err != nil {
+			return err
+		}
+		if err := ctx.JobLog.SetSnapshotPolicy(pipeline.ID, p.Name); err != nil {
+			LogRunnerError(g.ID, "snapshot policy", pipeline.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s snapshotsByTime) Len() int           { return len(s.names) }
+func (s snapshotsByTime) Less(i, j int) bool { return s.taken[s.names[i]] < s.taken[s.names[j]] }
+func (s snapshotsByTime) Swap(i, j int)      { s.names[i], s.names[j] = s.names[j], s.names[i] }
+
+func getSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	g := getRequestGuest(r)
+
+	policies, err := ctx.GetSnapshotPolicies(g.ID)
+	if err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	hr.JSON(http.StatusOK, policies)
+}
+
+func setSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	g := getRequestGuest(r)
+
+	var policies []*SnapshotPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policies); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	if err := validateSnapshotPolicies(policies); err != nil {
+		hr.JSONError(http.StatusBadRequest, err)
+		return
+	}
+	if err := ctx.SetSnapshotPolicies(g.ID, policies); err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	getSnapshotPolicies(w, r)
+}
+
+func deleteSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	hr := &HTTPResponse{w}
+	ctx := getContext(r)
+	g := getRequestGuest(r)
+
+	if err := ctx.SetSnapshotPolicies(g.ID, nil); err != nil {
+		hr.JSONError(http.StatusInternalServerError, err)
+		return
+	}
+	getSnapshotPolicies(w, r)
+}